@@ -0,0 +1,140 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/multierr"
+
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	runtimev1 "github.com/cerbos/cerbos/api/genpb/cerbos/runtime/v1"
+	"github.com/cerbos/cerbos/internal/audit"
+	"github.com/cerbos/cerbos/internal/compile"
+	"github.com/cerbos/cerbos/internal/engine"
+	"github.com/cerbos/cerbos/internal/namer"
+	"github.com/cerbos/cerbos/internal/policy"
+	"github.com/cerbos/cerbos/internal/schema"
+)
+
+// CheckSpec is a single check to evaluate against a policy.
+type CheckSpec struct {
+	Principal *Principal
+	Resource  *Resource
+	Actions   []string
+}
+
+// BehaviorChange describes an action whose effect differs between two versions of a policy.
+type BehaviorChange struct {
+	// Err is set if the check could not be evaluated against one of the policies.
+	Err    error
+	Action string
+	// Case is the index of the check in the list of test cases.
+	Case int
+	Old  effectv1.Effect
+	New  effectv1.Effect
+}
+
+// BehaviorDiff evaluates the given checks against both versions of the resource policy and returns the actions
+// whose effect changed. Each policy is compiled and evaluated on its own, so policies that import derived roles or
+// variables, or that depend on policies in parent scopes, produce changes with Err set for every check.
+func BehaviorDiff(oldPolicy, newPolicy *ResourcePolicy, testCases []CheckSpec) []BehaviorChange {
+	oldEffects, oldErr := evaluateChecks(oldPolicy, testCases)
+	newEffects, newErr := evaluateChecks(newPolicy, testCases)
+
+	var changes []BehaviorChange
+	for i, tc := range testCases {
+		if err := oldErr[i]; err != nil {
+			changes = append(changes, BehaviorChange{Case: i, Err: fmt.Errorf("failed to evaluate old policy: %w", err)})
+			continue
+		}
+
+		if err := newErr[i]; err != nil {
+			changes = append(changes, BehaviorChange{Case: i, Err: fmt.Errorf("failed to evaluate new policy: %w", err)})
+			continue
+		}
+
+		for _, action := range tc.Actions {
+			if o, n := oldEffects[i][action], newEffects[i][action]; o != n {
+				changes = append(changes, BehaviorChange{Case: i, Action: action, Old: o, New: n})
+			}
+		}
+	}
+
+	return changes
+}
+
+func evaluateChecks(rp *ResourcePolicy, testCases []CheckSpec) ([]map[string]effectv1.Effect, []error) {
+	effects := make([]map[string]effectv1.Effect, len(testCases))
+	errs := make([]error, len(testCases))
+	fail := func(err error) ([]map[string]effectv1.Effect, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return effects, errs
+	}
+
+	p, err := rp.build()
+	if err != nil {
+		return fail(err)
+	}
+
+	modID := namer.GenModuleID(p)
+	unit := &policy.CompilationUnit{ModID: modID}
+	unit.AddDefinition(modID, p)
+
+	schemaMgr := schema.NewNopManager()
+	rps, err := compile.Compile(unit, schemaMgr)
+	if err != nil {
+		return fail(fmt.Errorf("failed to compile policy: %w", err))
+	}
+
+	eng := engine.NewFromConf(context.Background(), &engine.Conf{DefaultPolicyVersion: namer.DefaultVersion}, engine.Components{
+		PolicyLoader: singlePolicyLoader{modID: modID, rps: rps},
+		SchemaMgr:    schemaMgr,
+		AuditLog:     audit.NewNopLog(),
+	})
+
+	for i, tc := range testCases {
+		if err := multierr.Combine(tc.Principal.Validate(), tc.Resource.Validate()); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		out, err := eng.Check(context.Background(), []*enginev1.CheckInput{{
+			Principal: tc.Principal.Proto(),
+			Resource:  tc.Resource.Proto(),
+			Actions:   tc.Actions,
+		}})
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		effects[i] = make(map[string]effectv1.Effect, len(tc.Actions))
+		for action, ae := range out[0].GetActions() {
+			effects[i][action] = ae.GetEffect()
+		}
+	}
+
+	return effects, errs
+}
+
+// singlePolicyLoader is an engine.PolicyLoader that serves a single compiled policy.
+type singlePolicyLoader struct {
+	rps   *runtimev1.RunnablePolicySet
+	modID namer.ModuleID
+}
+
+func (l singlePolicyLoader) GetFirstMatch(_ context.Context, candidates []namer.ModuleID) (*runtimev1.RunnablePolicySet, error) {
+	for _, c := range candidates {
+		if c == l.modID {
+			return l.rps, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+)
+
+func TestBehaviorDiff(t *testing.T) {
+	oldPolicy := NewResourcePolicy(resource, "default").
+		AddResourceRules(
+			NewAllowResourceRule("view").WithRoles("user"),
+			NewAllowResourceRule("edit").WithRoles("user").WithCondition(MatchExpr("request.resource.attr.owner == request.principal.id")),
+		)
+
+	newPolicy := NewResourcePolicy(resource, "default").
+		AddResourceRules(
+			NewAllowResourceRule("view", "edit").WithRoles("user"),
+		)
+
+	testCases := []CheckSpec{
+		{
+			Principal: NewPrincipal("alice", "user"),
+			Resource:  NewResource(resource, "XX125").WithAttr("owner", "alice"),
+			Actions:   []string{"view", "edit"},
+		},
+		{
+			Principal: NewPrincipal("bob", "user"),
+			Resource:  NewResource(resource, "XX125").WithAttr("owner", "alice"),
+			Actions:   []string{"view", "edit"},
+		},
+	}
+
+	require.Empty(t, BehaviorDiff(oldPolicy, oldPolicy, testCases))
+	require.Equal(t, []BehaviorChange{
+		{Case: 1, Action: "edit", Old: effectv1.Effect_EFFECT_DENY, New: effectv1.Effect_EFFECT_ALLOW},
+	}, BehaviorDiff(oldPolicy, newPolicy, testCases))
+
+	brokenPolicy := NewResourcePolicy(resource, "default").
+		WithDerivedRolesImports("missing_roles").
+		AddResourceRules(NewAllowResourceRule("view").WithDerivedRoles("owner"))
+
+	changes := BehaviorDiff(oldPolicy, brokenPolicy, testCases)
+	require.Len(t, changes, 2)
+	for _, c := range changes {
+		require.Error(t, c.Err)
+	}
+}
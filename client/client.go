@@ -435,7 +435,7 @@ func (gc *grpcClient) CheckResources(ctx context.Context, principal *Principal,
 	req := &requestv1.CheckResourcesRequest{
 		RequestId: reqID.String(),
 		Principal: principal.p,
-		Resources: resourceBatch.batch,
+		Resources: resourceBatch.entries(),
 	}
 
 	if gc.opts != nil {
@@ -0,0 +1,530 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/operators"
+	"go.uber.org/multierr"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	"github.com/cerbos/cerbos/internal/conditions"
+)
+
+// ValidateExprAgainstSchema compiles the given CEL expression and checks that every principal and resource attribute
+// it references is declared in the corresponding JSON schema. Comparisons between an attribute and a literal of an
+// incompatible type (for example, comparing a string attribute to a number) are reported as errors as well.
+// A nil or empty schema disables the checks for that side. Schema nodes that use composition keywords
+// such as $ref, allOf, anyOf or oneOf are not inspected.
+func ValidateExprAgainstSchema(expr string, resourceSchema, principalSchema []byte) error {
+	rs, err := parseAttrSchema(resourceSchema)
+	if err != nil {
+		return fmt.Errorf("invalid resource schema: %w", err)
+	}
+
+	ps, err := parseAttrSchema(principalSchema)
+	if err != nil {
+		return fmt.Errorf("invalid principal schema: %w", err)
+	}
+
+	ast, iss := conditions.StdEnv.Compile(expr)
+	if iss.Err() != nil {
+		return fmt.Errorf("failed to compile expression: %w", iss.Err())
+	}
+
+	parsed, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		return fmt.Errorf("failed to convert expression: %w", err)
+	}
+
+	c := &exprSchemaChecker{schemas: map[string]*attrSchema{
+		conditions.CELResourceAbbrev:  rs,
+		conditions.CELPrincipalAbbrev: ps,
+	}}
+	c.walk(parsed.GetExpr())
+
+	return c.err
+}
+
+type attrSchema struct {
+	Type                 any                    `json:"type"`
+	Properties           map[string]*attrSchema `json:"properties"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Ref                  string                 `json:"$ref"`
+	AllOf                []json.RawMessage      `json:"allOf"`
+	AnyOf                []json.RawMessage      `json:"anyOf"`
+	OneOf                []json.RawMessage      `json:"oneOf"`
+}
+
+func parseAttrSchema(b []byte) (*attrSchema, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	s := &attrSchema{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *attrSchema) opaque() bool {
+	return s.Ref != "" || len(s.AllOf) > 0 || len(s.AnyOf) > 0 || len(s.OneOf) > 0
+}
+
+func (s *attrSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		ts := make([]string, 0, len(t))
+		for _, v := range t {
+			if vs, ok := v.(string); ok {
+				ts = append(ts, vs)
+			}
+		}
+		return ts
+	default:
+		return nil
+	}
+}
+
+func (s *attrSchema) hasType(typ string) bool {
+	for _, t := range s.types() {
+		if t == typ || (typ == "number" && t == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// field returns the schema for the named property. The second return value is false if the property is not declared.
+// A nil schema with a true second return value means that the property is allowed but its shape is unknown.
+func (s *attrSchema) field(name string) (*attrSchema, bool) {
+	if p, ok := s.Properties[name]; ok {
+		return p, true
+	}
+
+	ap := strings.TrimSpace(string(s.AdditionalProperties))
+	switch {
+	case ap == "false":
+		return nil, false
+	case ap == "true":
+		return nil, true
+	case strings.HasPrefix(ap, "{"):
+		additional := &attrSchema{}
+		if err := json.Unmarshal(s.AdditionalProperties, additional); err != nil {
+			return nil, true
+		}
+		return additional, true
+	default:
+		// Without explicit properties the object is free-form.
+		return nil, len(s.Properties) == 0
+	}
+}
+
+type exprSchemaChecker struct {
+	err     error
+	schemas map[string]*attrSchema
+}
+
+func (c *exprSchemaChecker) walk(e *exprpb.Expr) {
+	if e == nil {
+		return
+	}
+
+	if _, _, ok := attrRef(e); ok {
+		c.resolve(e, true)
+		return
+	}
+
+	switch ek := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		c.walk(ek.SelectExpr.GetOperand())
+	case *exprpb.Expr_CallExpr:
+		c.checkComparison(ek.CallExpr)
+		c.walk(ek.CallExpr.GetTarget())
+		for _, arg := range ek.CallExpr.GetArgs() {
+			c.walk(arg)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, el := range ek.ListExpr.GetElements() {
+			c.walk(el)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range ek.StructExpr.GetEntries() {
+			c.walk(entry.GetMapKey())
+			c.walk(entry.GetValue())
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		ce := ek.ComprehensionExpr
+		c.walk(ce.GetIterRange())
+		c.walk(ce.GetAccuInit())
+		c.walk(ce.GetLoopCondition())
+		c.walk(ce.GetLoopStep())
+		c.walk(ce.GetResult())
+	}
+}
+
+// resolve finds the schema node referenced by the attribute expression.
+// If report is true, an error is recorded when the attribute is undeclared.
+func (c *exprSchemaChecker) resolve(e *exprpb.Expr, report bool) (*attrSchema, bool) {
+	root, path, _ := attrRef(e)
+	node := c.schemas[root]
+	if node == nil {
+		return nil, false
+	}
+
+	for i, seg := range path {
+		if node.opaque() {
+			return nil, false
+		}
+
+		if len(node.types()) > 0 && !node.hasType("object") {
+			if report {
+				c.err = multierr.Append(c.err, fmt.Errorf("attribute %s is not an object", attrLabel(root, path[:i])))
+			}
+			return nil, false
+		}
+
+		next, ok := node.field(seg)
+		if !ok {
+			if report {
+				c.err = multierr.Append(c.err, fmt.Errorf("reference to undeclared attribute %s", attrLabel(root, path[:i+1])))
+			}
+			return nil, false
+		}
+
+		if next == nil {
+			return nil, false
+		}
+		node = next
+	}
+
+	if node.opaque() {
+		return nil, false
+	}
+
+	return node, true
+}
+
+func (c *exprSchemaChecker) checkComparison(call *exprpb.Expr_Call) {
+	switch call.GetFunction() {
+	case operators.Equals, operators.NotEquals,
+		operators.Less, operators.LessEquals,
+		operators.Greater, operators.GreaterEquals:
+	default:
+		return
+	}
+
+	args := call.GetArgs()
+	if len(args) != 2 {
+		return
+	}
+
+	for i, arg := range args {
+		if _, _, ok := attrRef(arg); !ok {
+			continue
+		}
+
+		lit := args[1-i].GetConstExpr()
+		if lit == nil {
+			continue
+		}
+
+		litType := constJSONType(lit)
+		if litType == "" {
+			continue
+		}
+
+		node, ok := c.resolve(arg, false)
+		if !ok || len(node.types()) == 0 || node.hasType(litType) {
+			continue
+		}
+
+		root, path, _ := attrRef(arg)
+		c.err = multierr.Append(c.err, fmt.Errorf("attribute %s of type %s is compared to a %s",
+			attrLabel(root, path), strings.Join(node.types(), "|"), litType))
+	}
+}
+
+// attrRef returns the root (R or P) and the attribute path if the expression refers to a principal or resource attribute.
+func attrRef(e *exprpb.Expr) (root string, path []string, ok bool) {
+	var segs []string
+	for {
+		switch ek := e.ExprKind.(type) {
+		case *exprpb.Expr_SelectExpr:
+			segs = append(segs, ek.SelectExpr.GetField())
+			e = ek.SelectExpr.GetOperand()
+			continue
+		case *exprpb.Expr_CallExpr:
+			if ek.CallExpr.GetFunction() != operators.Index || len(ek.CallExpr.GetArgs()) != 2 {
+				return "", nil, false
+			}
+
+			key, isStr := ek.CallExpr.GetArgs()[1].GetConstExpr().GetConstantKind().(*exprpb.Constant_StringValue)
+			if !isStr {
+				return "", nil, false
+			}
+
+			segs = append(segs, key.StringValue)
+			e = ek.CallExpr.GetArgs()[0]
+			continue
+		case *exprpb.Expr_IdentExpr:
+			segs = append(segs, ek.IdentExpr.GetName())
+		default:
+			return "", nil, false
+		}
+		break
+	}
+
+	// segments were collected from the outermost selection inwards
+	for i, j := 0, len(segs)-1; i < j; i, j = i+1, j-1 {
+		segs[i], segs[j] = segs[j], segs[i]
+	}
+
+	switch segs[0] {
+	case conditions.CELResourceAbbrev, conditions.CELPrincipalAbbrev:
+		root, segs = segs[0], segs[1:]
+	case conditions.CELRequestIdent:
+		if len(segs) < 2 {
+			return "", nil, false
+		}
+
+		switch segs[1] {
+		case conditions.CELResourceField:
+			root = conditions.CELResourceAbbrev
+		case conditions.CELPrincipalField:
+			root = conditions.CELPrincipalAbbrev
+		default:
+			return "", nil, false
+		}
+		segs = segs[2:]
+	default:
+		return "", nil, false
+	}
+
+	if len(segs) < 2 || segs[0] != conditions.CELAttrField {
+		return "", nil, false
+	}
+
+	return root, segs[1:], true
+}
+
+func attrLabel(root string, path []string) string {
+	return fmt.Sprintf("%s.%s.%s", root, conditions.CELAttrField, strings.Join(path, "."))
+}
+
+func constJSONType(c *exprpb.Constant) string {
+	switch c.GetConstantKind().(type) {
+	case *exprpb.Constant_StringValue:
+		return "string"
+	case *exprpb.Constant_Int64Value, *exprpb.Constant_Uint64Value, *exprpb.Constant_DoubleValue:
+		return "number"
+	case *exprpb.Constant_BoolValue:
+		return "boolean"
+	default:
+		return ""
+	}
+}
+
+var filterBinaryOps = map[string]string{
+	"eq":   "==",
+	"ne":   "!=",
+	"lt":   "<",
+	"le":   "<=",
+	"gt":   ">",
+	"ge":   ">=",
+	"in":   "in",
+	"add":  "+",
+	"sub":  "-",
+	"mult": "*",
+	"div":  "/",
+	"mod":  "%",
+}
+
+var filterLambdaOps = map[string]struct{}{
+	"all":        {},
+	"exists":     {},
+	"exists_one": {},
+	"filter":     {},
+	"map":        {},
+}
+
+// filterToCEL renders a query plan filter condition as CEL source text.
+func filterToCEL(op *enginev1.PlanResourcesFilter_Expression_Operand) (string, error) {
+	b := new(strings.Builder)
+	if err := writeFilterOperand(b, op, false); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func writeFilterOperand(b *strings.Builder, op *enginev1.PlanResourcesFilter_Expression_Operand, nested bool) error {
+	switch t := op.GetNode().(type) {
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Value:
+		// protojson output is deliberately unstable, so encoding/json is used to get a predictable rendering.
+		val, err := json.Marshal(t.Value.AsInterface())
+		if err != nil {
+			return fmt.Errorf("failed to render value: %w", err)
+		}
+		b.Write(val)
+		return nil
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Variable:
+		b.WriteString(t.Variable)
+		return nil
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Expression:
+		return writeFilterExpr(b, t.Expression, nested)
+	default:
+		return fmt.Errorf("unexpected operand %T", t)
+	}
+}
+
+func writeFilterExpr(b *strings.Builder, expr *enginev1.PlanResourcesFilter_Expression, nested bool) error {
+	operands := expr.GetOperands()
+	operator := expr.GetOperator()
+
+	wantOperands := func(n int) error {
+		if len(operands) != n {
+			return fmt.Errorf("operator %q expects %d operands, got %d", operator, n, len(operands))
+		}
+		return nil
+	}
+
+	if sym, ok := filterBinaryOps[operator]; ok {
+		if err := wantOperands(2); err != nil {
+			return err
+		}
+		return writeFilterJoined(b, operands, " "+sym+" ", nested)
+	}
+
+	if _, ok := filterLambdaOps[operator]; ok {
+		if err := wantOperands(2); err != nil {
+			return err
+		}
+
+		lambda := operands[1].GetExpression()
+		if lambda.GetOperator() != "lambda" || len(lambda.GetOperands()) != 2 {
+			return fmt.Errorf("operator %q expects a lambda as the second operand", operator)
+		}
+
+		if err := writeFilterOperand(b, operands[0], true); err != nil {
+			return err
+		}
+		fmt.Fprintf(b, ".%s(%s, ", operator, lambda.GetOperands()[1].GetVariable())
+		if err := writeFilterOperand(b, lambda.GetOperands()[0], false); err != nil {
+			return err
+		}
+		b.WriteString(")")
+		return nil
+	}
+
+	switch operator {
+	case "and":
+		return writeFilterJoined(b, operands, " && ", nested)
+	case "or":
+		return writeFilterJoined(b, operands, " || ", nested)
+	case "not":
+		if err := wantOperands(1); err != nil {
+			return err
+		}
+		b.WriteString("!")
+		return writeFilterOperand(b, operands[0], true)
+	case "index":
+		if err := wantOperands(2); err != nil {
+			return err
+		}
+		if err := writeFilterOperand(b, operands[0], true); err != nil {
+			return err
+		}
+		b.WriteString("[")
+		if err := writeFilterOperand(b, operands[1], false); err != nil {
+			return err
+		}
+		b.WriteString("]")
+		return nil
+	case "get-field":
+		if err := wantOperands(2); err != nil {
+			return err
+		}
+		if err := writeFilterOperand(b, operands[0], true); err != nil {
+			return err
+		}
+		b.WriteString(".")
+		b.WriteString(operands[1].GetVariable())
+		return nil
+	case "list":
+		b.WriteString("[")
+		if err := writeFilterJoined(b, operands, ", ", false); err != nil {
+			return err
+		}
+		b.WriteString("]")
+		return nil
+	case "struct":
+		b.WriteString("{")
+		for i, op := range operands {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+
+			field := op.GetExpression()
+			if field.GetOperator() != "set-field" || len(field.GetOperands()) != 2 {
+				return fmt.Errorf("operator %q expects set-field operands", operator)
+			}
+
+			if err := writeFilterOperand(b, field.GetOperands()[0], false); err != nil {
+				return err
+			}
+			b.WriteString(": ")
+			if err := writeFilterOperand(b, field.GetOperands()[1], false); err != nil {
+				return err
+			}
+		}
+		b.WriteString("}")
+		return nil
+	case "":
+		return errors.New("missing operator")
+	default:
+		// Other functions are rendered using the global function call syntax.
+		b.WriteString(operator)
+		b.WriteString("(")
+		if err := writeFilterJoined(b, operands, ", ", false); err != nil {
+			return err
+		}
+		b.WriteString(")")
+		return nil
+	}
+}
+
+func writeFilterJoined(b *strings.Builder, operands []*enginev1.PlanResourcesFilter_Expression_Operand, sep string, parens bool) error {
+	if parens {
+		b.WriteString("(")
+	}
+
+	nestOperands := sep != ", "
+	for i, op := range operands {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+
+		if err := writeFilterOperand(b, op, nestOperands); err != nil {
+			return err
+		}
+	}
+
+	if parens {
+		b.WriteString(")")
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testResourceSchema = `{
+  "type": "object",
+  "properties": {
+    "department": {"type": "string"},
+    "count": {"type": "integer"},
+    "owner": {
+      "type": "object",
+      "properties": {
+        "id": {"type": "string"}
+      }
+    },
+    "labels": {
+      "type": "object",
+      "additionalProperties": {"type": "string"}
+    }
+  }
+}`
+
+	testPrincipalSchema = `{
+  "type": "object",
+  "properties": {
+    "department": {"type": "string"}
+  }
+}`
+)
+
+func TestValidateExprAgainstSchema(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expr    string
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			expr: `R.attr.department == P.attr.department && R.attr.count > 5 && R.attr.owner.id == request.principal.id && R.attr.labels["team"] == "a"`,
+		},
+		{
+			name:    "undeclared_resource_attr",
+			expr:    `R.attr.region == "eu"`,
+			wantErr: []string{"undeclared attribute R.attr.region"},
+		},
+		{
+			name:    "undeclared_nested_attr",
+			expr:    `request.resource.attr.owner.name == "x"`,
+			wantErr: []string{"undeclared attribute R.attr.owner.name"},
+		},
+		{
+			name:    "undeclared_principal_attr",
+			expr:    `has(P.attr.manager)`,
+			wantErr: []string{"undeclared attribute P.attr.manager"},
+		},
+		{
+			name:    "type_mismatch",
+			expr:    `R.attr.department == 42 || 1 < P.attr.department`,
+			wantErr: []string{"R.attr.department of type string is compared to a number", "P.attr.department of type string is compared to a number"},
+		},
+		{
+			name:    "not_an_object",
+			expr:    `R.attr.department.name == "x"`,
+			wantErr: []string{"attribute R.attr.department is not an object"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateExprAgainstSchema(tc.expr, []byte(testResourceSchema), []byte(testPrincipalSchema))
+			if len(tc.wantErr) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			for _, want := range tc.wantErr {
+				require.ErrorContains(t, err, want)
+			}
+		})
+	}
+
+	t.Run("invalid_expr", func(t *testing.T) {
+		require.Error(t, ValidateExprAgainstSchema(`R.attr.department ==`, nil, nil))
+	})
+
+	t.Run("no_schema", func(t *testing.T) {
+		require.NoError(t, ValidateExprAgainstSchema(`R.attr.anything == 1`, nil, nil))
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// InferSchema produces a JSON schema describing the union of the attributes seen in the given examples.
+// A property is only marked as required if it is present in every example (or every instance of the enclosing object).
+// The inferred schema is meant to be a starting point that is refined by hand.
+func InferSchema(examples []map[string]any) ([]byte, error) {
+	if len(examples) == 0 {
+		return nil, errors.New("at least one example is required")
+	}
+
+	root := &schemaNode{}
+	for i, ex := range examples {
+		v, err := toStructPB(ex, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid example #%d: %w", i+1, err)
+		}
+		root.add(v)
+	}
+
+	s := root.jsonSchema()
+	s["$schema"] = jsonSchemaDialect
+
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal schema: %w", err)
+	}
+
+	return out, nil
+}
+
+type schemaNode struct {
+	types      map[string]struct{}
+	properties map[string]*schemaNode
+	propCounts map[string]int
+	items      *schemaNode
+	objects    int
+}
+
+func (n *schemaNode) add(v *structpb.Value) {
+	if n.types == nil {
+		n.types = make(map[string]struct{})
+	}
+
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		n.types["boolean"] = struct{}{}
+	case *structpb.Value_NumberValue:
+		n.types["number"] = struct{}{}
+	case *structpb.Value_StringValue:
+		n.types["string"] = struct{}{}
+	case *structpb.Value_ListValue:
+		n.types["array"] = struct{}{}
+		if n.items == nil {
+			n.items = &schemaNode{}
+		}
+		for _, item := range k.ListValue.GetValues() {
+			n.items.add(item)
+		}
+	case *structpb.Value_StructValue:
+		n.types["object"] = struct{}{}
+		if n.properties == nil {
+			n.properties = make(map[string]*schemaNode)
+			n.propCounts = make(map[string]int)
+		}
+		n.objects++
+		for key, fv := range k.StructValue.GetFields() {
+			prop, ok := n.properties[key]
+			if !ok {
+				prop = &schemaNode{}
+				n.properties[key] = prop
+			}
+			prop.add(fv)
+			n.propCounts[key]++
+		}
+	default:
+		n.types["null"] = struct{}{}
+	}
+}
+
+func (n *schemaNode) jsonSchema() map[string]any {
+	s := make(map[string]any)
+
+	types := make([]string, 0, len(n.types))
+	for t := range n.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	switch len(types) {
+	case 0:
+	case 1:
+		s["type"] = types[0]
+	default:
+		s["type"] = types
+	}
+
+	if n.properties != nil {
+		props := make(map[string]any, len(n.properties))
+		var required []string
+		for key, prop := range n.properties {
+			props[key] = prop.jsonSchema()
+			if n.propCounts[key] == n.objects {
+				required = append(required, key)
+			}
+		}
+		s["properties"] = props
+
+		if len(required) > 0 {
+			sort.Strings(required)
+			s["required"] = required
+		}
+	}
+
+	if n.items != nil && len(n.items.types) > 0 {
+		s["items"] = n.items.jsonSchema()
+	}
+
+	return s
+}
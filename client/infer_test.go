@@ -0,0 +1,58 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInferSchema(t *testing.T) {
+	have, err := InferSchema([]map[string]any{
+		{
+			"owner":  "alice",
+			"public": true,
+			"tags":   []any{"a", "b"},
+			"geo":    map[string]any{"country": "NZ", "region": "AKL"},
+		},
+		{
+			"owner":  "bob",
+			"amount": 42,
+			"tags":   []any{},
+			"geo":    map[string]any{"country": "GB"},
+		},
+		{
+			"owner":  "carol",
+			"public": nil,
+			"geo":    map[string]any{"country": "US"},
+		},
+	})
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "properties": {
+    "amount": {"type": "number"},
+    "geo": {
+      "type": "object",
+      "properties": {
+        "country": {"type": "string"},
+        "region": {"type": "string"}
+      },
+      "required": ["country"]
+    },
+    "owner": {"type": "string"},
+    "public": {"type": ["boolean", "null"]},
+    "tags": {"type": "array", "items": {"type": "string"}}
+  },
+  "required": ["geo", "owner"]
+}`, string(have))
+
+	_, err = InferSchema(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,94 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	"github.com/cerbos/cerbos/internal/policy"
+)
+
+// LintIssue is a problem found by a lint rule.
+type LintIssue struct {
+	// Rule is the name of the lint rule that found the problem.
+	Rule string
+	// Message is a human-readable description of the problem.
+	Message string
+}
+
+// LintRule checks a policy for violations of a convention.
+type LintRule interface {
+	Check(*policyv1.Policy) []LintIssue
+}
+
+var (
+	lintRules   []LintRule
+	lintRulesMu sync.RWMutex
+)
+
+func init() {
+	RegisterLintRule(deprecatedFieldsLint{})
+	RegisterLintRule(ruleNamesLint{})
+}
+
+// RegisterLintRule adds a rule to the set of rules applied by Lint and by validation with the Strict profile.
+// The built-in rules check that policies don't use deprecated fields and that every rule has a name.
+func RegisterLintRule(rule LintRule) {
+	lintRulesMu.Lock()
+	defer lintRulesMu.Unlock()
+
+	lintRules = append(lintRules, rule)
+}
+
+// Lint applies the registered lint rules to the policy, in registration order, and returns the issues they found.
+func Lint(p *policyv1.Policy) []LintIssue {
+	lintRulesMu.RLock()
+	defer lintRulesMu.RUnlock()
+
+	var issues []LintIssue
+	for _, rule := range lintRules {
+		issues = append(issues, rule.Check(p)...)
+	}
+
+	return issues
+}
+
+type deprecatedFieldsLint struct{}
+
+func (deprecatedFieldsLint) Check(p *policyv1.Policy) []LintIssue {
+	if fields := policy.DeprecatedFields(p); len(fields) > 0 {
+		return []LintIssue{{Rule: "deprecated-fields", Message: fmt.Sprintf("policy uses deprecated fields: %s", strings.Join(fields, ", "))}}
+	}
+
+	return nil
+}
+
+type ruleNamesLint struct{}
+
+func (ruleNamesLint) Check(p *policyv1.Policy) []LintIssue {
+	const name = "rule-names"
+
+	var issues []LintIssue
+	switch pt := p.PolicyType.(type) {
+	case *policyv1.Policy_ResourcePolicy:
+		for i, rule := range pt.ResourcePolicy.GetRules() {
+			if rule.GetName() == "" {
+				issues = append(issues, LintIssue{Rule: name, Message: fmt.Sprintf("rule #%d does not have a name", i+1)})
+			}
+		}
+	case *policyv1.Policy_PrincipalPolicy:
+		for i, rule := range pt.PrincipalPolicy.GetRules() {
+			for j, action := range rule.GetActions() {
+				if action.GetName() == "" {
+					issues = append(issues, LintIssue{Rule: name, Message: fmt.Sprintf("action #%d of rule #%d does not have a name", j+1, i+1)})
+				}
+			}
+		}
+	}
+
+	return issues
+}
@@ -0,0 +1,85 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+)
+
+type noWildcardRolesInProd struct{}
+
+func (noWildcardRolesInProd) Check(p *policyv1.Policy) []LintIssue {
+	rp := p.GetResourcePolicy()
+	if rp.GetScope() != "prod" {
+		return nil
+	}
+
+	var issues []LintIssue
+	for _, rule := range rp.GetRules() {
+		for _, role := range rule.GetRoles() {
+			if role == "*" {
+				issues = append(issues, LintIssue{Rule: "no-wildcard-roles-in-prod", Message: "wildcard role in prod scope"})
+			}
+		}
+	}
+
+	return issues
+}
+
+// registerTestLintRule registers the rule for the duration of the test and restores the previous set of rules afterwards.
+func registerTestLintRule(t *testing.T, rule LintRule) {
+	t.Helper()
+
+	lintRulesMu.Lock()
+	saved := append([]LintRule(nil), lintRules...)
+	lintRulesMu.Unlock()
+
+	t.Cleanup(func() {
+		lintRulesMu.Lock()
+		defer lintRulesMu.Unlock()
+
+		lintRules = saved
+	})
+
+	RegisterLintRule(rule)
+}
+
+func TestLint(t *testing.T) {
+	registerTestLintRule(t, noWildcardRolesInProd{})
+
+	p := &policyv1.Policy{
+		ApiVersion: apiVersion,
+		PolicyType: &policyv1.Policy_ResourcePolicy{
+			ResourcePolicy: &policyv1.ResourcePolicy{
+				Resource: "leave_request",
+				Version:  "default",
+				Scope:    "prod",
+				Rules: []*policyv1.ResourceRule{
+					{Name: "view", Actions: []string{"view"}, Roles: []string{"*"}, Effect: effectv1.Effect_EFFECT_ALLOW},
+					{Actions: []string{"edit"}, Roles: []string{"user"}, Effect: effectv1.Effect_EFFECT_ALLOW},
+				},
+			},
+		},
+	}
+
+	require.Equal(t, []LintIssue{
+		{Rule: "rule-names", Message: "rule #2 does not have a name"},
+		{Rule: "no-wildcard-roles-in-prod", Message: "wildcard role in prod scope"},
+	}, Lint(p))
+
+	require.NoError(t, ValidatePolicy(p, ServerCompatible))
+	require.ErrorContains(t, ValidatePolicy(p, Strict), "wildcard role in prod scope")
+
+	p.GetResourcePolicy().Scope = "dev"
+	p.GetResourcePolicy().Rules[1].Name = "edit"
+	require.Empty(t, Lint(p))
+}
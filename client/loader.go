@@ -0,0 +1,236 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+
+	"go.uber.org/multierr"
+
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	"github.com/cerbos/cerbos/internal/namer"
+	"github.com/cerbos/cerbos/internal/policy"
+	"github.com/cerbos/cerbos/internal/schema"
+	"github.com/cerbos/cerbos/internal/util"
+)
+
+// PolicyLoader loads policies from a directory and keeps track of the files it has seen
+// so that subsequent loads only return the policies that have changed.
+type PolicyLoader struct {
+	fsys  fs.FS
+	files map[string]loadedFile
+	kinds map[PolicyKind]struct{}
+	root  string
+	mu    sync.Mutex
+}
+
+type loadedFile struct {
+	fqn  string
+	hash uint64
+}
+
+// PolicyKind is the kind of a policy (resource, principal, derived roles or exported variables).
+type PolicyKind = policy.Kind
+
+const (
+	ResourcePolicyKind  = policy.ResourceKind
+	PrincipalPolicyKind = policy.PrincipalKind
+	DerivedRolesKind    = policy.DerivedRolesKind
+	ExportVariablesKind = policy.ExportVariablesKind
+)
+
+// LoaderOpt is an option for the policy loader.
+type LoaderOpt func(*PolicyLoader)
+
+// WithKinds restricts the loader to policies of the given kinds. Policies of other kinds are skipped.
+// By default, policies of all kinds are loaded.
+func WithKinds(kinds ...PolicyKind) LoaderOpt {
+	return func(pl *PolicyLoader) {
+		pl.kinds = make(map[PolicyKind]struct{}, len(kinds))
+		for _, k := range kinds {
+			pl.kinds[k] = struct{}{}
+		}
+	}
+}
+
+// NewPolicyLoader creates a new policy loader for the policies stored under the given root of the filesystem.
+func NewPolicyLoader(fsys fs.FS, root string, opts ...LoaderOpt) *PolicyLoader {
+	pl := &PolicyLoader{
+		fsys:  fsys,
+		root:  root,
+		files: make(map[string]loadedFile),
+	}
+
+	for _, opt := range opts {
+		opt(pl)
+	}
+
+	return pl
+}
+
+// LoadChanged walks the policy directory and returns the policies from files whose contents have changed since the
+// previous call, along with the sorted list of FQNs of policies that no longer exist. The first call returns all policies.
+// Files that fail to parse or validate are reported in the returned error and retried on the next call.
+func (pl *PolicyLoader) LoadChanged() ([]*policyv1.Policy, []string, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	var changed []*policyv1.Policy
+	var removed []string
+	var errs error
+
+	seen := make(map[string]struct{}, len(pl.files))
+	err := walkPolicyFiles(pl.fsys, pl.root, func(filePath string) error {
+		seen[filePath] = struct{}{}
+
+		contents, err := fs.ReadFile(pl.fsys, filePath)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to read %s: %w", filePath, err))
+			return nil
+		}
+
+		hash := util.HashStr(string(contents))
+		prev, exists := pl.files[filePath]
+		if exists && prev.hash == hash {
+			return nil
+		}
+
+		p, err := policy.ReadPolicy(bytes.NewReader(contents))
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to read policy from %s: %w", filePath, err))
+			return nil
+		}
+
+		if !pl.includesKind(p) {
+			// Remember the hash so that the file isn't parsed again until it changes.
+			if exists && prev.fqn != "" {
+				removed = append(removed, prev.fqn)
+			}
+			pl.files[filePath] = loadedFile{hash: hash}
+			return nil
+		}
+
+		if err := policy.Validate(p); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("invalid policy in %s: %w", filePath, err))
+			return nil
+		}
+
+		fqn := namer.FQN(p)
+		if exists && prev.fqn != "" && prev.fqn != fqn {
+			removed = append(removed, prev.fqn)
+		}
+
+		pl.files[filePath] = loadedFile{fqn: fqn, hash: hash}
+		changed = append(changed, policy.WithMetadata(p, filePath, nil, filePath))
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk %s: %w", pl.root, err)
+	}
+
+	for filePath, lf := range pl.files {
+		if _, ok := seen[filePath]; !ok {
+			if lf.fqn != "" {
+				removed = append(removed, lf.fqn)
+			}
+			delete(pl.files, filePath)
+		}
+	}
+	sort.Strings(removed)
+
+	return changed, removed, errs
+}
+
+func (pl *PolicyLoader) includesKind(p *policyv1.Policy) bool {
+	if pl.kinds == nil || p.PolicyType == nil {
+		return true
+	}
+
+	_, ok := pl.kinds[policy.GetKind(p)]
+	return ok
+}
+
+// walkPolicyFiles calls fn for each policy file under root, skipping the schemas and test data directories,
+// test files and hidden files.
+func walkPolicyFiles(fsys fs.FS, root string, fn func(filePath string) error) error {
+	return fs.WalkDir(fsys, root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if filePath == path.Join(root, schema.Directory) ||
+				d.Name() == util.TestDataDirectory ||
+				util.IsHidden(d.Name()) {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		if !util.IsSupportedFileType(d.Name()) ||
+			util.IsSupportedTestFile(d.Name()) ||
+			util.IsHidden(d.Name()) {
+			return nil
+		}
+
+		return fn(filePath)
+	})
+}
+
+// FileError is an error encountered while loading a policy file.
+type FileError struct {
+	Err  error
+	File string
+}
+
+func (fe FileError) Error() string {
+	return fmt.Sprintf("%s: %v", fe.File, fe.Err)
+}
+
+func (fe FileError) Unwrap() error {
+	return fe.Err
+}
+
+// LoadDirTolerant loads all the policies under the given root of the filesystem, continuing past files that cannot be
+// read, parsed or validated. It returns a policy set containing the policies that were loaded successfully
+// and the errors encountered for the other files, in walk order.
+func LoadDirTolerant(fsys fs.FS, root string) (*PolicySet, []FileError) {
+	ps := NewPolicySet()
+	var fileErrs []FileError
+
+	err := walkPolicyFiles(fsys, root, func(filePath string) error {
+		f, err := fsys.Open(filePath)
+		if err != nil {
+			fileErrs = append(fileErrs, FileError{File: filePath, Err: fmt.Errorf("failed to open file: %w", err)})
+			return nil
+		}
+		defer f.Close()
+
+		p, err := policy.ReadPolicy(f)
+		if err != nil {
+			fileErrs = append(fileErrs, FileError{File: filePath, Err: fmt.Errorf("failed to read policy: %w", err)})
+			return nil
+		}
+
+		if err := policy.Validate(p); err != nil {
+			fileErrs = append(fileErrs, FileError{File: filePath, Err: fmt.Errorf("invalid policy: %w", err)})
+			return nil
+		}
+
+		ps.AddPolicies(policy.WithMetadata(p, filePath, nil, filePath))
+		return nil
+	})
+	if err != nil {
+		fileErrs = append(fileErrs, FileError{File: root, Err: fmt.Errorf("failed to walk directory: %w", err)})
+	}
+
+	return ps, fileErrs
+}
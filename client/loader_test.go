@@ -0,0 +1,131 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	leaveRequestPolicy = `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  resource: leave_request
+  version: default
+  rules:
+    - actions: ["view"]
+      effect: EFFECT_ALLOW
+      roles: ["user"]
+`
+
+	expensePolicy = `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  resource: expense
+  version: default
+  rules:
+    - actions: ["view"]
+      effect: EFFECT_ALLOW
+      roles: ["user"]
+`
+)
+
+func TestPolicyLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"policies/leave_request.yaml":         {Data: []byte(leaveRequestPolicy)},
+		"policies/expense.yaml":               {Data: []byte(expensePolicy)},
+		"policies/_schemas/principal.json":    {Data: []byte(`{}`)},
+		"policies/testdata/principals.yaml":   {Data: []byte(`{}`)},
+		"policies/leave_request_test.yaml":    {Data: []byte(`{}`)},
+		"policies/.hidden/leave_request.yaml": {Data: []byte(`{}`)},
+	}
+
+	pl := NewPolicyLoader(fsys, "policies")
+
+	changed, removed, err := pl.LoadChanged()
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	require.Empty(t, removed)
+
+	changed, removed, err = pl.LoadChanged()
+	require.NoError(t, err)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+
+	fsys["policies/leave_request.yaml"] = &fstest.MapFile{Data: []byte(leaveRequestPolicy + `    - actions: ["approve"]
+      effect: EFFECT_ALLOW
+      roles: ["manager"]
+`)}
+	delete(fsys, "policies/expense.yaml")
+
+	changed, removed, err = pl.LoadChanged()
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	require.Equal(t, "leave_request", changed[0].GetResourcePolicy().Resource)
+	require.Equal(t, []string{"cerbos.resource.expense.vdefault"}, removed)
+
+	fsys["policies/broken.yaml"] = &fstest.MapFile{Data: []byte(`resourcePolicy: [`)}
+	changed, removed, err = pl.LoadChanged()
+	require.Error(t, err)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+}
+
+func TestPolicyLoaderWithKinds(t *testing.T) {
+	fsys := fstest.MapFS{
+		"policies/leave_request.yaml": {Data: []byte(leaveRequestPolicy)},
+		"policies/common_roles.yaml": {Data: []byte(`---
+apiVersion: api.cerbos.dev/v1
+derivedRoles:
+  name: common_roles
+  definitions:
+    - name: owner
+      parentRoles: ["user"]
+`)},
+	}
+
+	changed, _, err := NewPolicyLoader(fsys, "policies").LoadChanged()
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+
+	pl := NewPolicyLoader(fsys, "policies", WithKinds(DerivedRolesKind))
+	changed, removed, err := pl.LoadChanged()
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	require.Equal(t, "common_roles", changed[0].GetDerivedRoles().Name)
+	require.Empty(t, removed)
+
+	delete(fsys, "policies/leave_request.yaml")
+	changed, removed, err = pl.LoadChanged()
+	require.NoError(t, err)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+}
+
+func TestLoadDirTolerant(t *testing.T) {
+	fsys := fstest.MapFS{
+		"policies/leave_request.yaml":   {Data: []byte(leaveRequestPolicy)},
+		"policies/expense.yaml":         {Data: []byte(expensePolicy)},
+		"policies/broken.yaml":          {Data: []byte(`resourcePolicy: [`)},
+		"policies/nested/invalid.yaml":  {Data: []byte("---\napiVersion: api.cerbos.dev/v1\nresourcePolicy:\n  resource: album\n  version: default\n  rules:\n    - actions: [\"view\"]\n      effect: EFFECT_ALLOW\n")},
+		"policies/testdata/broken.yaml": {Data: []byte(`{`)},
+	}
+
+	ps, fileErrs := LoadDirTolerant(fsys, "policies")
+	require.Equal(t, 2, ps.Size())
+	require.NoError(t, ps.Validate())
+	require.Len(t, fileErrs, 2)
+	require.Equal(t, "policies/broken.yaml", fileErrs[0].File)
+	require.Equal(t, "policies/nested/invalid.yaml", fileErrs[1].File)
+	require.ErrorContains(t, fileErrs[1], "policies/nested/invalid.yaml: invalid policy")
+
+	_, fileErrs = LoadDirTolerant(fsys, "missing")
+	require.Len(t, fileErrs, 1)
+}
@@ -4,16 +4,28 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
+	"github.com/google/uuid"
 	"go.uber.org/multierr"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/known/structpb"
 
 	auditv1 "github.com/cerbos/cerbos/api/genpb/cerbos/audit/v1"
@@ -23,6 +35,7 @@ import (
 	requestv1 "github.com/cerbos/cerbos/api/genpb/cerbos/request/v1"
 	responsev1 "github.com/cerbos/cerbos/api/genpb/cerbos/response/v1"
 	schemav1 "github.com/cerbos/cerbos/api/genpb/cerbos/schema/v1"
+	"github.com/cerbos/cerbos/internal/namer"
 	"github.com/cerbos/cerbos/internal/policy"
 	"github.com/cerbos/cerbos/internal/schema"
 	"github.com/cerbos/cerbos/internal/util"
@@ -30,10 +43,18 @@ import (
 
 const apiVersion = "api.cerbos.dev/v1"
 
+// TrimSpaceNormalizer is an ID normalizer that removes leading and trailing whitespace.
+// See Principal.WithNormalizedID and Resource.WithNormalizedID.
+func TrimSpaceNormalizer(id string) string {
+	return strings.TrimSpace(id)
+}
+
 // Principal is a container for principal data.
 type Principal struct {
-	p   *enginev1.Principal
-	err error
+	p             *enginev1.Principal
+	err           error
+	typeRecorder  *AttrTypeRecorder
+	strictNumbers bool
 }
 
 // NewPrincipal creates a new principal object with the given ID and roles.
@@ -46,6 +67,94 @@ func NewPrincipal(id string, roles ...string) *Principal {
 	}
 }
 
+// NewPrincipalFromProto creates a new principal object from a copy of the given protobuf representation.
+func NewPrincipalFromProto(p *enginev1.Principal) *Principal {
+	if p == nil {
+		return &Principal{p: &enginev1.Principal{}}
+	}
+
+	return &Principal{p: proto.Clone(p).(*enginev1.Principal)}
+}
+
+// PrincipalFromClaims creates a new principal from a set of OIDC ID token claims.
+// The `sub` claim is used as the principal ID and the roles are read from the claim named by roleClaim,
+// which can be either a single string or a list of strings. All other claims are added as attributes, except for
+// claims whose keys are reserved (see ReservedAttrKeys) such as the OAuth `scope` claim, which are skipped so that they
+// can't shadow the principal fields.
+func PrincipalFromClaims(claims map[string]any, roleClaim string) (*Principal, error) {
+	sub, ok := claims["sub"].(string)
+	if !ok || sub == "" {
+		return nil, errors.New("missing or invalid 'sub' claim")
+	}
+
+	var roles []string
+	switch r := claims[roleClaim].(type) {
+	case string:
+		roles = []string{r}
+	case []string:
+		roles = r
+	case []any:
+		roles = make([]string, len(r))
+		for i, v := range r {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid value of type %T in '%s' claim", v, roleClaim)
+			}
+			roles[i] = s
+		}
+	case nil:
+		return nil, fmt.Errorf("missing '%s' claim", roleClaim)
+	default:
+		return nil, fmt.Errorf("invalid '%s' claim of type %T", roleClaim, r)
+	}
+
+	attr, err := claimsToAttrs(claims, false, "sub", roleClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewPrincipal(sub, roles...)
+	p.p.Attr = attr
+	return p, nil
+}
+
+// NewPrincipalFromJWTClaims creates a new principal with the given ID and roles, and adds the decoded JWT claims
+// as attributes. The ID and roles arguments take precedence over the claims: claims whose keys are reserved
+// (see ReservedAttrKeys), such as the OAuth `scope` claim, are skipped so that they can't shadow the principal fields.
+// Claims that can't be converted to attribute values are reported by Err.
+func NewPrincipalFromJWTClaims(id string, claims map[string]any, roles ...string) *Principal {
+	p := NewPrincipal(id, roles...)
+	p.p.Attr, p.err = claimsToAttrs(claims, false)
+	return p
+}
+
+// claimsToAttrs converts token claims to attribute values, leaving out the claims named by skip and the claims with
+// reserved keys. Claims that can't be converted are reported in the returned error and the remaining claims are
+// still converted.
+func claimsToAttrs(claims map[string]any, strictNumbers bool, skip ...string) (map[string]*structpb.Value, error) {
+	omit := make(map[string]struct{}, len(skip))
+	for _, k := range append(skip, ReservedAttrKeys()...) {
+		omit[k] = struct{}{}
+	}
+
+	var err error
+	attr := make(map[string]*structpb.Value, len(claims))
+	for _, k := range sortedKeys(claims) {
+		if _, ok := omit[k]; ok {
+			continue
+		}
+
+		pbVal, convErr := toStructPB(claims[k], strictNumbers)
+		if convErr != nil {
+			err = multierr.Append(err, fmt.Errorf("invalid value for claim '%s': %w", k, convErr))
+			continue
+		}
+		attr[k] = pbVal
+	}
+
+	return attr, err
+}
+
 // WithPolicyVersion sets the policy version for this principal.
 func (p *Principal) WithPolicyVersion(policyVersion string) *Principal {
 	p.p.PolicyVersion = policyVersion
@@ -64,6 +173,20 @@ func (p *Principal) WithScope(scope string) *Principal {
 	return p
 }
 
+// WithNormalizedID replaces the principal ID with the result of applying the given normalizer to it.
+func (p *Principal) WithNormalizedID(normalizer func(string) string) *Principal {
+	p.p.Id = normalizer(p.p.Id)
+	return p
+}
+
+// WithAttrTypeRecorder makes WithAttr, WithAttributes, WithAttributesFromStruct, WithAttrsFromJSON, WithInt64Attr,
+// MergeAttributes and MergeFrom report the attributes they set to the given recorder.
+// Type changes flagged by the recorder are accumulated into the principal errors.
+func (p *Principal) WithAttrTypeRecorder(rec *AttrTypeRecorder) *Principal {
+	p.typeRecorder = rec
+	return p
+}
+
 // WithAttributes merges the given attributes to principal's existing attributes.
 func (p *Principal) WithAttributes(attr map[string]any) *Principal {
 	if p.p.Attr == nil {
@@ -71,17 +194,112 @@ func (p *Principal) WithAttributes(attr map[string]any) *Principal {
 	}
 
 	for k, v := range attr {
-		pbVal, err := util.ToStructPB(v)
+		pbVal, err := toStructPB(v, p.strictNumbers)
+		if err != nil {
+			p.err = multierr.Append(p.err, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
+			continue
+		}
+		if err := p.typeRecorder.Check(k, pbVal); err != nil {
+			p.err = multierr.Append(p.err, err)
+		}
+		p.p.Attr[k] = pbVal
+	}
+
+	return p
+}
+
+// MergeAttributes merges the given attributes to principal's existing attributes.
+// When a key already exists, the value is replaced by the result of calling resolve with the existing and incoming values.
+// If resolve returns nil, the attribute is removed.
+func (p *Principal) MergeAttributes(attr map[string]any, resolve func(key string, existing, incoming *structpb.Value) *structpb.Value) *Principal {
+	if p.p.Attr == nil {
+		p.p.Attr = make(map[string]*structpb.Value, len(attr))
+	}
+
+	for k, v := range attr {
+		pbVal, err := toStructPB(v, p.strictNumbers)
 		if err != nil {
 			p.err = multierr.Append(p.err, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
 			continue
 		}
+
+		if existing, ok := p.p.Attr[k]; ok {
+			pbVal = resolve(k, existing, pbVal)
+		}
+
+		if pbVal == nil {
+			delete(p.p.Attr, k)
+			continue
+		}
+		if err := p.typeRecorder.Check(k, pbVal); err != nil {
+			p.err = multierr.Append(p.err, err)
+		}
+		p.p.Attr[k] = pbVal
+	}
+
+	return p
+}
+
+// MergeFrom copies the attributes of other into the principal. On key collisions, the value from other replaces
+// the existing value. Any errors accumulated during the construction of other are added to the principal's errors.
+func (p *Principal) MergeFrom(other *Principal) *Principal {
+	if other == nil {
+		return p
+	}
+
+	p.err = multierr.Append(p.err, other.err)
+
+	attr := other.p.GetAttr()
+	if len(attr) == 0 {
+		return p
+	}
+
+	if p.p.Attr == nil {
+		p.p.Attr = make(map[string]*structpb.Value, len(attr))
+	}
+
+	for k, v := range attr {
+		pbVal := proto.Clone(v).(*structpb.Value)
+		if err := p.typeRecorder.Check(k, pbVal); err != nil {
+			p.err = multierr.Append(p.err, err)
+		}
 		p.p.Attr[k] = pbVal
 	}
 
 	return p
 }
 
+// LastWins is an attribute conflict resolver that keeps the incoming value.
+func LastWins(_ string, _, incoming *structpb.Value) *structpb.Value {
+	return incoming
+}
+
+// UnionLists is an attribute conflict resolver that combines the elements of two lists, omitting duplicates.
+// Values that are not both lists are resolved using LastWins.
+func UnionLists(key string, existing, incoming *structpb.Value) *structpb.Value {
+	el, il := existing.GetListValue(), incoming.GetListValue()
+	if el == nil || il == nil {
+		return LastWins(key, existing, incoming)
+	}
+
+	union := &structpb.ListValue{Values: make([]*structpb.Value, 0, len(el.Values)+len(il.Values))}
+	for _, v := range append(el.GetValues(), il.GetValues()...) {
+		dup := false
+		for _, u := range union.Values {
+			if proto.Equal(u, v) {
+				dup = true
+				break
+			}
+		}
+
+		if !dup {
+			union.Values = append(union.Values, v)
+		}
+	}
+
+	return structpb.NewListValue(union)
+}
+
 // WithAttr adds a new attribute to the principal.
 // It will overwrite any existing attribute having the same key.
 func (p *Principal) WithAttr(key string, value any) *Principal {
@@ -89,16 +307,118 @@ func (p *Principal) WithAttr(key string, value any) *Principal {
 		p.p.Attr = make(map[string]*structpb.Value)
 	}
 
-	pbVal, err := util.ToStructPB(value)
+	pbVal, err := toStructPB(value, p.strictNumbers)
 	if err != nil {
 		p.err = multierr.Append(p.err, fmt.Errorf("invalid attribute value for '%s': %w", key, err))
 		return p
 	}
 
+	if err := p.typeRecorder.Check(key, pbVal); err != nil {
+		p.err = multierr.Append(p.err, err)
+	}
 	p.p.Attr[key] = pbVal
 	return p
 }
 
+// WithAttributesFromStruct merges the exported fields of the given struct to principal's existing attributes.
+// Field names are taken from `json` tags where present and fields tagged with `-` are skipped.
+// Fields of embedded structs are promoted to the top level.
+func (p *Principal) WithAttributesFromStruct(v any) *Principal {
+	attr, err := structToAttrs(v)
+	if err != nil {
+		p.err = multierr.Append(p.err, fmt.Errorf("invalid attributes struct: %w", err))
+		return p
+	}
+
+	return p.WithAttributes(attr)
+}
+
+// WithAttrsFromJSON merges the attributes from the given JSON object to principal's existing attributes.
+// Integers are preserved exactly: those that can't be represented by a float64 are encoded as decimal strings.
+func (p *Principal) WithAttrsFromJSON(data []byte) *Principal {
+	attr, err := jsonToAttrPB(data)
+	if err != nil {
+		p.err = multierr.Append(p.err, fmt.Errorf("invalid attributes: %w", err))
+		return p
+	}
+
+	if p.p.Attr == nil {
+		p.p.Attr = make(map[string]*structpb.Value, len(attr))
+	}
+
+	for k, v := range attr {
+		if err := p.typeRecorder.Check(k, v); err != nil {
+			p.err = multierr.Append(p.err, err)
+		}
+		p.p.Attr[k] = v
+	}
+
+	return p
+}
+
+// DeleteAttr removes the attribute with the given key from the principal. It does nothing if the attribute is not set.
+// Removing the last attribute leaves the principal with an empty attribute map.
+func (p *Principal) DeleteAttr(key string) *Principal {
+	delete(p.p.Attr, key)
+	return p
+}
+
+// WithInt64Attr adds a new integer attribute to the principal without losing precision.
+// Values outside the range that can be represented exactly by a float64 are encoded as decimal strings.
+// It will overwrite any existing attribute having the same key.
+func (p *Principal) WithInt64Attr(key string, value int64) *Principal {
+	if p.p.Attr == nil {
+		p.p.Attr = make(map[string]*structpb.Value)
+	}
+
+	pbVal := int64ToStructPB(value)
+	if err := p.typeRecorder.Check(key, pbVal); err != nil {
+		p.err = multierr.Append(p.err, err)
+	}
+	p.p.Attr[key] = pbVal
+	return p
+}
+
+// WithStrictNumbers causes integer attributes added after this call to be encoded as decimal strings
+// if they cannot be represented exactly by a float64.
+func (p *Principal) WithStrictNumbers() *Principal {
+	p.strictNumbers = true
+	return p
+}
+
+// SetAttributesPB replaces the principal's attributes with a copy of the given protobuf values.
+func (p *Principal) SetAttributesPB(attr map[string]*structpb.Value) *Principal {
+	p.p.Attr = cloneAttrPB(attr)
+	return p
+}
+
+// Clone returns a deep copy of the principal, including its attributes, without the accumulated errors.
+// The clone is independent of the original, so concurrent callers can each take a clone of a shared principal
+// and modify it without synchronisation.
+func (p *Principal) Clone() *Principal {
+	return &Principal{
+		p:             proto.Clone(p.p).(*enginev1.Principal),
+		typeRecorder:  p.typeRecorder,
+		strictNumbers: p.strictNumbers,
+	}
+}
+
+// KeepOnly returns a copy of the principal that only contains the named attributes.
+// The original principal is not modified.
+func (p *Principal) KeepOnly(keys ...string) *Principal {
+	c := p.Clone()
+	c.err = p.err
+	c.p.Attr = keepAttrPB(c.p.Attr, keys)
+
+	return c
+}
+
+// FlatAttributes returns the principal's attributes as a flat map where nested keys are joined with dots
+// and list elements are keyed by their index (for example, `tags.0`).
+func (p *Principal) FlatAttributes() map[string]any {
+	return flattenAttrs(p.p.GetAttr())
+}
+
 // ID returns the principal ID.
 func (p *Principal) ID() string {
 	return p.p.GetId()
@@ -109,6 +429,34 @@ func (p *Principal) Roles() []string {
 	return p.p.GetRoles()
 }
 
+// Scope returns the principal scope.
+func (p *Principal) Scope() string {
+	return p.p.GetScope()
+}
+
+// PolicyVersion returns the principal policy version.
+func (p *Principal) PolicyVersion() string {
+	return p.p.GetPolicyVersion()
+}
+
+// Attributes returns a copy of the principal's attributes converted to Go values.
+func (p *Principal) Attributes() map[string]any {
+	return attrsFromPB(p.p.GetAttr())
+}
+
+// HasRoles returns true if the principal has at least one non-empty role.
+// A principal without roles is rejected by Validate, so this is mainly useful for checking principals
+// before they are fully built, for example to detect that loading roles from an identity provider failed.
+func (p *Principal) HasRoles() bool {
+	for _, r := range p.p.GetRoles() {
+		if r != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Proto returns the underlying protobuf object representing the principal.
 func (p *Principal) Proto() *enginev1.Principal {
 	return p.p
@@ -125,13 +473,66 @@ func (p *Principal) Validate() error {
 		return p.err
 	}
 
+	roles := make([]any, len(p.p.GetRoles()))
+	for i, r := range p.p.GetRoles() {
+		roles[i] = r
+	}
+	rolesVal, _ := structpb.NewList(roles)
+
+	if err := checkReservedAttrs(p.p.GetAttr(), map[string]*structpb.Value{
+		"id":            structpb.NewStringValue(p.p.GetId()),
+		"roles":         structpb.NewListValue(rolesVal),
+		"policyVersion": structpb.NewStringValue(p.p.GetPolicyVersion()),
+		"scope":         structpb.NewStringValue(p.p.GetScope()),
+	}); err != nil {
+		return err
+	}
+
 	return p.p.Validate()
 }
 
+// ReservedAttrKeys returns the attribute keys that shadow the top-level fields of principals and resources.
+// Principal.Validate and Resource.Validate reject attributes with these keys if their value differs from the value
+// of the corresponding field, because conditions such as `R.attr.id == P.id` would then silently use a different ID
+// than the one the request is for.
+func ReservedAttrKeys() []string {
+	return []string{"id", "kind", "policyVersion", "roles", "scope"}
+}
+
+// checkReservedAttrs checks that the attributes with reserved keys match the given top-level fields.
+func checkReservedAttrs(attr, fields map[string]*structpb.Value) error {
+	var err error
+	for _, k := range ReservedAttrKeys() {
+		v, ok := attr[k]
+		if !ok {
+			continue
+		}
+
+		if fv, isField := fields[k]; isField && !proto.Equal(v, fv) {
+			err = multierr.Append(err, fmt.Errorf("attribute '%s' shadows the %s field with a different value", k, k))
+		}
+	}
+
+	return err
+}
+
+// MaxResourceParentDepth is the maximum number of levels in a resource hierarchy built using Resource.WithParent.
+const MaxResourceParentDepth = 8
+
+const parentAttrKey = "parent"
+
 // Resource is a single resource instance.
 type Resource struct {
-	r   *enginev1.Resource
-	err error
+	r             *enginev1.Resource
+	err           error
+	typeRecorder  *AttrTypeRecorder
+	lazyAttrs     []lazyAttr
+	strictNumbers bool
+}
+
+type lazyAttr struct {
+	fn  func() (any, error)
+	key string
 }
 
 // NewResource creates a new instance of a resource.
@@ -141,12 +542,29 @@ func NewResource(kind, id string) *Resource {
 	}
 }
 
+// NewResourceFromProto creates a new instance of a resource from a copy of the given protobuf representation.
+func NewResourceFromProto(r *enginev1.Resource) *Resource {
+	if r == nil {
+		return &Resource{r: &enginev1.Resource{}}
+	}
+
+	return &Resource{r: proto.Clone(r).(*enginev1.Resource)}
+}
+
 // WithPolicyVersion sets the policy version for this resource.
 func (r *Resource) WithPolicyVersion(policyVersion string) *Resource {
 	r.r.PolicyVersion = policyVersion
 	return r
 }
 
+// WithAttrTypeRecorder makes WithAttr, WithAttributes, WithAttributesFromStruct, WithAttributesFromProto,
+// WithAttrsFromJSON, WithInt64Attr and WithLazyAttr report the attributes they set to the given recorder.
+// Type changes flagged by the recorder are accumulated into the resource errors.
+func (r *Resource) WithAttrTypeRecorder(rec *AttrTypeRecorder) *Resource {
+	r.typeRecorder = rec
+	return r
+}
+
 // WithAttributes merges the given attributes to the resource's existing attributes.
 func (r *Resource) WithAttributes(attr map[string]any) *Resource {
 	if r.r.Attr == nil {
@@ -154,11 +572,14 @@ func (r *Resource) WithAttributes(attr map[string]any) *Resource {
 	}
 
 	for k, v := range attr {
-		pbVal, err := util.ToStructPB(v)
+		pbVal, err := toStructPB(v, r.strictNumbers)
 		if err != nil {
 			r.err = multierr.Append(r.err, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
 			continue
 		}
+		if err := r.typeRecorder.Check(k, pbVal); err != nil {
+			r.err = multierr.Append(r.err, err)
+		}
 		r.r.Attr[k] = pbVal
 	}
 
@@ -172,34 +593,322 @@ func (r *Resource) WithAttr(key string, value any) *Resource {
 		r.r.Attr = make(map[string]*structpb.Value)
 	}
 
-	pbVal, err := util.ToStructPB(value)
+	pbVal, err := toStructPB(value, r.strictNumbers)
 	if err != nil {
 		r.err = multierr.Append(r.err, fmt.Errorf("invalid attribute value for '%s': %w", key, err))
 		return r
 	}
 
+	if err := r.typeRecorder.Check(key, pbVal); err != nil {
+		r.err = multierr.Append(r.err, err)
+	}
 	r.r.Attr[key] = pbVal
 	return r
 }
 
+// WithAttributesFromProto adds the named fields of the given message as attributes of the resource.
+// Fields are looked up by their protobuf name (or JSON name) and the attribute keys are the protobuf names.
+// Nested messages are converted using their canonical JSON representation and enums are represented by their names.
+func (r *Resource) WithAttributesFromProto(msg proto.Message, fields ...string) *Resource {
+	if msg == nil || !msg.ProtoReflect().IsValid() {
+		r.err = multierr.Append(r.err, errors.New("message must not be nil"))
+		return r
+	}
+
+	m := msg.ProtoReflect()
+	desc := m.Descriptor().Fields()
+	for _, name := range fields {
+		fd := desc.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = desc.ByJSONName(name)
+		}
+
+		if fd == nil {
+			r.err = multierr.Append(r.err, fmt.Errorf("message %s has no field named '%s'", m.Descriptor().FullName(), name))
+			continue
+		}
+
+		v, err := protoFieldValue(m, fd)
+		if err != nil {
+			r.err = multierr.Append(r.err, fmt.Errorf("failed to convert field '%s': %w", name, err))
+			continue
+		}
+
+		r.WithAttr(string(fd.Name()), v)
+	}
+
+	return r
+}
+
+// WithAttributesFromStruct merges the exported fields of the given struct to the resource's existing attributes.
+// Field names are taken from `json` tags where present and fields tagged with `-` are skipped.
+// Fields of embedded structs are promoted to the top level.
+func (r *Resource) WithAttributesFromStruct(v any) *Resource {
+	attr, err := structToAttrs(v)
+	if err != nil {
+		r.err = multierr.Append(r.err, fmt.Errorf("invalid attributes struct: %w", err))
+		return r
+	}
+
+	return r.WithAttributes(attr)
+}
+
+// WithAttrsFromJSON merges the attributes from the given JSON object to the resource's existing attributes.
+// Integers are preserved exactly: those that can't be represented by a float64 are encoded as decimal strings.
+func (r *Resource) WithAttrsFromJSON(data []byte) *Resource {
+	attr, err := jsonToAttrPB(data)
+	if err != nil {
+		r.err = multierr.Append(r.err, fmt.Errorf("invalid attributes: %w", err))
+		return r
+	}
+
+	if r.r.Attr == nil {
+		r.r.Attr = make(map[string]*structpb.Value, len(attr))
+	}
+
+	for k, v := range attr {
+		if err := r.typeRecorder.Check(k, v); err != nil {
+			r.err = multierr.Append(r.err, err)
+		}
+		r.r.Attr[k] = v
+	}
+
+	return r
+}
+
+// DeleteAttr removes the attribute with the given key from the resource, including any pending lazy attribute
+// with that key. It does nothing if the attribute is not set.
+// Removing the last attribute leaves the resource with an empty attribute map.
+func (r *Resource) DeleteAttr(key string) *Resource {
+	delete(r.r.Attr, key)
+
+	pending := r.lazyAttrs[:0]
+	for _, la := range r.lazyAttrs {
+		if la.key != key {
+			pending = append(pending, la)
+		}
+	}
+	r.lazyAttrs = pending
+
+	return r
+}
+
+// WithInt64Attr adds a new integer attribute to the resource without losing precision.
+// Values outside the range that can be represented exactly by a float64 are encoded as decimal strings.
+// It will overwrite any existing attribute having the same key.
+func (r *Resource) WithInt64Attr(key string, value int64) *Resource {
+	if r.r.Attr == nil {
+		r.r.Attr = make(map[string]*structpb.Value)
+	}
+
+	pbVal := int64ToStructPB(value)
+	if err := r.typeRecorder.Check(key, pbVal); err != nil {
+		r.err = multierr.Append(r.err, err)
+	}
+	r.r.Attr[key] = pbVal
+	return r
+}
+
+// WithStrictNumbers causes integer attributes added after this call to be encoded as decimal strings
+// if they cannot be represented exactly by a float64.
+func (r *Resource) WithStrictNumbers() *Resource {
+	r.strictNumbers = true
+	return r
+}
+
+// SetAttributesPB replaces the resource's attributes with a copy of the given protobuf values.
+func (r *Resource) SetAttributesPB(attr map[string]*structpb.Value) *Resource {
+	r.r.Attr = cloneAttrPB(attr)
+	return r
+}
+
+// WithLazyAttr adds an attribute whose value is computed by calling fn when the resource is first used in a request,
+// or when Proto or Validate is called. The function is called at most once and any error it returns is
+// accumulated into the resource errors. The computed value overwrites any existing attribute having the same key.
+func (r *Resource) WithLazyAttr(key string, fn func() (any, error)) *Resource {
+	r.lazyAttrs = append(r.lazyAttrs, lazyAttr{key: key, fn: fn})
+	return r
+}
+
+func (r *Resource) resolveLazyAttrs() {
+	if len(r.lazyAttrs) == 0 {
+		return
+	}
+
+	pending := r.lazyAttrs
+	r.lazyAttrs = nil
+	for _, la := range pending {
+		v, err := la.fn()
+		if err != nil {
+			r.err = multierr.Append(r.err, fmt.Errorf("failed to compute attribute value for '%s': %w", la.key, err))
+			continue
+		}
+
+		r.WithAttr(la.key, v)
+	}
+}
+
+// Clone returns a deep copy of the resource, including its attributes, without the accumulated errors.
+// Pending lazy attributes are carried over and are computed separately for the clone.
+// The clone is independent of the original, so concurrent callers can each take a clone of a template resource
+// and modify it without synchronisation.
+func (r *Resource) Clone() *Resource {
+	c := &Resource{
+		r:             proto.Clone(r.r).(*enginev1.Resource),
+		typeRecorder:  r.typeRecorder,
+		strictNumbers: r.strictNumbers,
+	}
+
+	if len(r.lazyAttrs) > 0 {
+		c.lazyAttrs = make([]lazyAttr, len(r.lazyAttrs))
+		copy(c.lazyAttrs, r.lazyAttrs)
+	}
+
+	return c
+}
+
+// KeepOnly returns a copy of the resource that only contains the named attributes.
+// Lazy attributes with other keys are dropped without being computed. The original resource is not modified.
+func (r *Resource) KeepOnly(keys ...string) *Resource {
+	c := r.Clone()
+	c.err = r.err
+	c.r.Attr = keepAttrPB(c.r.Attr, keys)
+
+	keep := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		keep[k] = struct{}{}
+	}
+
+	c.lazyAttrs = nil
+	for _, la := range r.lazyAttrs {
+		if _, ok := keep[la.key]; ok {
+			c.lazyAttrs = append(c.lazyAttrs, la)
+		}
+	}
+
+	return c
+}
+
+// FlatAttributes returns the resource's attributes as a flat map where nested keys are joined with dots
+// and list elements are keyed by their index (for example, `tags.0`). Pending lazy attributes are resolved first.
+func (r *Resource) FlatAttributes() map[string]any {
+	r.resolveLazyAttrs()
+	return flattenAttrs(r.r.GetAttr())
+}
+
+// RequireAttributes checks that each of the named attributes is set to a non-null value and returns an error
+// listing the ones that are missing. Pending lazy attributes are resolved first.
+func (r *Resource) RequireAttributes(keys ...string) error {
+	r.resolveLazyAttrs()
+
+	var missing []string
+	for _, k := range keys {
+		v, ok := r.r.GetAttr()[k]
+		if !ok || v == nil || v.GetKind() == nil {
+			missing = append(missing, k)
+			continue
+		}
+
+		if _, isNull := v.GetKind().(*structpb.Value_NullValue); isNull {
+			missing = append(missing, k)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("resource '%s' of kind '%s' is missing required attributes: %s", r.r.GetId(), r.r.GetKind(), strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// WithParent adds the given resource as the `parent` attribute of this resource so that policies can refer to
+// the attributes of the parent as, for example, `R.attr.parent.owner`. The parent's kind and ID are available as
+// `R.attr.parent.kind` and `R.attr.parent.id`, overriding any parent attributes with those names.
+// Hierarchies deeper than MaxResourceParentDepth levels are rejected.
+func (r *Resource) WithParent(parent *Resource) *Resource {
+	if parent == nil {
+		r.err = multierr.Append(r.err, errors.New("parent resource must not be nil"))
+		return r
+	}
+
+	parent.resolveLazyAttrs()
+	if parent.err != nil {
+		r.err = multierr.Append(r.err, fmt.Errorf("invalid parent resource: %w", parent.err))
+		return r
+	}
+
+	if depth := resourceParentDepth(parent.r.GetAttr()) + 1; depth > MaxResourceParentDepth {
+		r.err = multierr.Append(r.err, fmt.Errorf("resource hierarchy depth %d exceeds the maximum of %d", depth, MaxResourceParentDepth))
+		return r
+	}
+
+	fields := cloneAttrPB(parent.r.GetAttr())
+	if fields == nil {
+		fields = make(map[string]*structpb.Value, 2) //nolint:gomnd
+	}
+	fields["kind"] = structpb.NewStringValue(parent.r.GetKind())
+	fields["id"] = structpb.NewStringValue(parent.r.GetId())
+
+	if r.r.Attr == nil {
+		r.r.Attr = make(map[string]*structpb.Value)
+	}
+	r.r.Attr[parentAttrKey] = structpb.NewStructValue(&structpb.Struct{Fields: fields})
+
+	return r
+}
+
+// resourceParentDepth returns the number of parents nested in the given attributes.
+func resourceParentDepth(attr map[string]*structpb.Value) int {
+	depth := 0
+	for p := attr[parentAttrKey].GetStructValue(); p != nil; p = p.GetFields()[parentAttrKey].GetStructValue() {
+		depth++
+	}
+
+	return depth
+}
+
 // WithScope sets the scope this resource belongs to.
 func (r *Resource) WithScope(scope string) *Resource {
 	r.r.Scope = scope
 	return r
 }
 
+// WithNormalizedID replaces the resource ID with the result of applying the given normalizer to it.
+func (r *Resource) WithNormalizedID(normalizer func(string) string) *Resource {
+	r.r.Id = normalizer(r.r.Id)
+	return r
+}
+
 // ID returns the resource ID.
 func (r *Resource) ID() string {
 	return r.r.GetId()
 }
 
-// Kind returns the resource kind.
-func (r *Resource) Kind() string {
-	return r.r.GetKind()
+// Kind returns the resource kind.
+func (r *Resource) Kind() string {
+	return r.r.GetKind()
+}
+
+// Scope returns the resource scope.
+func (r *Resource) Scope() string {
+	return r.r.GetScope()
+}
+
+// PolicyVersion returns the resource policy version.
+func (r *Resource) PolicyVersion() string {
+	return r.r.GetPolicyVersion()
+}
+
+// Attributes returns a copy of the resource's attributes converted to Go values.
+// Pending lazy attributes are resolved first.
+func (r *Resource) Attributes() map[string]any {
+	r.resolveLazyAttrs()
+	return attrsFromPB(r.r.GetAttr())
 }
 
 // Proto returns the underlying protobuf object representing the resource.
 func (r *Resource) Proto() *enginev1.Resource {
+	r.resolveLazyAttrs()
 	return r.r
 }
 
@@ -210,10 +919,20 @@ func (r *Resource) Err() error {
 
 // Validate checks whether the resource is valid.
 func (r *Resource) Validate() error {
+	r.resolveLazyAttrs()
 	if r.err != nil {
 		return r.err
 	}
 
+	if err := checkReservedAttrs(r.r.GetAttr(), map[string]*structpb.Value{
+		"id":            structpb.NewStringValue(r.r.GetId()),
+		"kind":          structpb.NewStringValue(r.r.GetKind()),
+		"policyVersion": structpb.NewStringValue(r.r.GetPolicyVersion()),
+		"scope":         structpb.NewStringValue(r.r.GetScope()),
+	}); err != nil {
+		return err
+	}
+
 	return r.r.Validate()
 }
 
@@ -242,18 +961,96 @@ func (rs *ResourceSet) AddResourceInstance(id string, attr map[string]any) *Reso
 		rs.rs.Instances = make(map[string]*requestv1.AttributesMap)
 	}
 
+	pbAttr, err := instanceAttrPB(attr)
+	if err != nil {
+		rs.err = multierr.Append(rs.err, err)
+	}
+
+	rs.rs.Instances[id] = &requestv1.AttributesMap{Attr: pbAttr}
+	return rs
+}
+
+// AddResourceInstanceWithErr adds a new resource instance to the resource set and returns the error.
+// If any of the attribute values are invalid, the instance is not added and the set's accumulated errors are not modified.
+func (rs *ResourceSet) AddResourceInstanceWithErr(id string, attr map[string]any) (*ResourceSet, error) {
+	pbAttr, err := instanceAttrPB(attr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource instance '%s': %w", id, err)
+	}
+
+	if rs.rs.Instances == nil {
+		rs.rs.Instances = make(map[string]*requestv1.AttributesMap)
+	}
+
+	rs.rs.Instances[id] = &requestv1.AttributesMap{Attr: pbAttr}
+	return rs, nil
+}
+
+// RemoveResourceInstance removes the resource instance with the given ID from the resource set, if it exists.
+func (rs *ResourceSet) RemoveResourceInstance(id string) *ResourceSet {
+	delete(rs.rs.Instances, id)
+	return rs
+}
+
+// Size returns the number of resource instances in the resource set.
+func (rs *ResourceSet) Size() int {
+	return len(rs.rs.GetInstances())
+}
+
+// Merge adds the resource instances from other to the resource set. Instances from other replace existing instances
+// with the same ID. Both sets must have the same kind and, if both have a policy version, the same policy version.
+// Any errors accumulated during the construction of other are added to the set's errors.
+func (rs *ResourceSet) Merge(other *ResourceSet) *ResourceSet {
+	if other == nil {
+		return rs
+	}
+
+	rs.err = multierr.Append(rs.err, other.err)
+
+	if rs.rs.Kind != other.rs.Kind {
+		rs.err = multierr.Append(rs.err, fmt.Errorf("cannot merge resource set of kind '%s' into resource set of kind '%s'", other.rs.Kind, rs.rs.Kind))
+		return rs
+	}
+
+	switch {
+	case other.rs.PolicyVersion == "" || other.rs.PolicyVersion == rs.rs.PolicyVersion:
+	case rs.rs.PolicyVersion == "":
+		rs.rs.PolicyVersion = other.rs.PolicyVersion
+	default:
+		rs.err = multierr.Append(rs.err, fmt.Errorf("cannot merge resource set with policy version '%s' into resource set with policy version '%s'", other.rs.PolicyVersion, rs.rs.PolicyVersion))
+		return rs
+	}
+
+	if len(other.rs.Instances) == 0 {
+		return rs
+	}
+
+	if rs.rs.Instances == nil {
+		rs.rs.Instances = make(map[string]*requestv1.AttributesMap, len(other.rs.Instances))
+	}
+
+	for id, inst := range other.rs.Instances {
+		rs.rs.Instances[id] = proto.Clone(inst).(*requestv1.AttributesMap)
+	}
+
+	return rs
+}
+
+// instanceAttrPB converts the attributes of a resource instance. Invalid values are omitted from the result
+// and reported in the returned error.
+func instanceAttrPB(attr map[string]any) (map[string]*structpb.Value, error) {
+	var outErr error
 	pbAttr := make(map[string]*structpb.Value, len(attr))
 	for k, v := range attr {
-		pbVal, err := structpb.NewValue(v)
+		pbVal, err := toStructPB(v, false)
 		if err != nil {
-			rs.err = multierr.Append(rs.err, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
+			outErr = multierr.Append(outErr, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
 			continue
 		}
 		pbAttr[k] = pbVal
 	}
 
-	rs.rs.Instances[id] = &requestv1.AttributesMap{Attr: pbAttr}
-	return rs
+	return pbAttr, outErr
 }
 
 // Err returns any errors accumulated during the construction of this resource set.
@@ -291,6 +1088,27 @@ func (crsr *CheckResourceSetResponse) IsAllowed(resourceID, action string) bool
 	return effect == effectv1.Effect_EFFECT_ALLOW
 }
 
+// AllActions returns a copy of the map of actions to their effects for the given resource instance.
+// Returns nil if the resource instance is not contained in the response.
+func (crsr *CheckResourceSetResponse) AllActions(resourceID string) map[string]effectv1.Effect {
+	res, ok := crsr.GetResourceInstances()[resourceID]
+	if !ok || res == nil {
+		return nil
+	}
+
+	actions := make(map[string]effectv1.Effect, len(res.Actions))
+	for action, effect := range res.Actions {
+		actions[action] = effect
+	}
+
+	return actions
+}
+
+// ResourceIDs returns the sorted list of the IDs of the resource instances contained in the response.
+func (crsr *CheckResourceSetResponse) ResourceIDs() []string {
+	return sortedKeys(crsr.GetResourceInstances())
+}
+
 // Errors returns all validation errors returned by the server.
 func (crsr *CheckResourceSetResponse) Errors() error {
 	var err error
@@ -315,8 +1133,9 @@ func (crsr *CheckResourceSetResponse) MarshalJSON() ([]byte, error) {
 
 // ResourceBatch is a container for a batch of heterogeneous resources.
 type ResourceBatch struct {
-	err   error
-	batch []*requestv1.CheckResourcesRequest_ResourceEntry
+	err          error
+	defaultScope string
+	batch        []*requestv1.CheckResourcesRequest_ResourceEntry
 }
 
 // NewResourceBatch creates a new resource batch.
@@ -330,20 +1149,177 @@ func (rb *ResourceBatch) Add(resource *Resource, actions ...string) *ResourceBat
 		return rb
 	}
 
+	entry, err := newResourceEntry(resource, actions)
+	if err != nil {
+		rb.err = multierr.Append(rb.err, err)
+		return rb
+	}
+
+	rb.batch = append(rb.batch, entry)
+	return rb
+}
+
+// AddWithErr adds a new resource to the batch and returns the error.
+// Unlike Add, a nil resource or an empty list of actions is reported as an error, and the batch errors are not modified.
+func (rb *ResourceBatch) AddWithErr(resource *Resource, actions ...string) (*ResourceBatch, error) {
+	if resource == nil {
+		return nil, errors.New("resource must not be nil")
+	}
+
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("no actions provided for resource '%s'", resource.r.Id)
+	}
+
+	entry, err := newResourceEntry(resource, actions)
+	if err != nil {
+		return nil, err
+	}
+
+	rb.batch = append(rb.batch, entry)
+	return rb, nil
+}
+
+func newResourceEntry(resource *Resource, actions []string) (*requestv1.CheckResourcesRequest_ResourceEntry, error) {
+	if len(resource.lazyAttrs) > 0 {
+		resource.resolveLazyAttrs()
+		if err := resource.Err(); err != nil {
+			return nil, fmt.Errorf("invalid resource '%s': %w", resource.r.Id, err)
+		}
+	}
+
 	entry := &requestv1.CheckResourcesRequest_ResourceEntry{
 		Actions:  actions,
 		Resource: resource.r,
 	}
 
 	if err := entry.Validate(); err != nil {
-		rb.err = multierr.Append(rb.err, fmt.Errorf("invalid resource '%s': %w", resource.r.Id, err))
+		return nil, fmt.Errorf("invalid resource '%s': %w", resource.r.Id, err)
+	}
+
+	return entry, nil
+}
+
+// AddResources adds the given resources to the batch, each with the same set of actions.
+func (rb *ResourceBatch) AddResources(actions []string, resources ...*Resource) *ResourceBatch {
+	for _, r := range resources {
+		rb.Add(r, actions...)
+	}
+
+	return rb
+}
+
+// Merge appends the entries of other to the batch and adds any errors accumulated during the construction of other
+// to the batch errors. The default scope of other is applied to its entries before they are appended.
+func (rb *ResourceBatch) Merge(other *ResourceBatch) *ResourceBatch {
+	if other == nil {
 		return rb
 	}
 
-	rb.batch = append(rb.batch, entry)
+	rb.err = multierr.Append(rb.err, other.err)
+	rb.batch = append(rb.batch, other.entries()...)
+	return rb
+}
+
+// Chunk splits the batch into batches containing at most size entries each, preserving the order of the entries.
+// The default scope is retained and any errors accumulated by the batch are carried by the first chunk.
+// A batch that is not larger than size results in a single chunk. If size is not positive, the result is a single
+// chunk containing all the entries and an error.
+func (rb *ResourceBatch) Chunk(size int) []*ResourceBatch {
+	if size <= 0 {
+		return []*ResourceBatch{{
+			err:          multierr.Append(rb.err, fmt.Errorf("invalid chunk size %d: must be greater than zero", size)),
+			defaultScope: rb.defaultScope,
+			batch:        rb.batch[:len(rb.batch):len(rb.batch)],
+		}}
+	}
+
+	chunks := make([]*ResourceBatch, 0, (len(rb.batch)+size-1)/size)
+	for start := 0; start < len(rb.batch) || start == 0; start += size {
+		end := MinInt(start+size, len(rb.batch))
+		chunks = append(chunks, &ResourceBatch{
+			defaultScope: rb.defaultScope,
+			batch:        rb.batch[start:end:end],
+		})
+	}
+
+	chunks[0].err = rb.err
+	return chunks
+}
+
+// WithDefaultScope sets the scope of the resources in the batch that don't have an explicit scope.
+// The default is applied when the request is built, so it affects resources added before and after this call.
+func (rb *ResourceBatch) WithDefaultScope(scope string) *ResourceBatch {
+	rb.defaultScope = scope
 	return rb
 }
 
+// MarshalBinary serializes the entries of the batch, with the default scope applied, using the protobuf wire format.
+// Errors accumulated during the construction of the batch are not serialized.
+func (rb *ResourceBatch) MarshalBinary() ([]byte, error) {
+	return proto.Marshal(&requestv1.CheckResourcesRequest{Resources: rb.entries()})
+}
+
+// UnmarshalResourceBatch restores a resource batch serialized with MarshalBinary.
+// Restored entries are validated and any validation failures are accumulated into the batch errors.
+func UnmarshalResourceBatch(data []byte) (*ResourceBatch, error) {
+	req := &requestv1.CheckResourcesRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resource batch: %w", err)
+	}
+
+	rb := NewResourceBatch()
+	for _, entry := range req.Resources {
+		if err := entry.Validate(); err != nil {
+			rb.err = multierr.Append(rb.err, fmt.Errorf("invalid resource '%s': %w", entry.GetResource().GetId(), err))
+			continue
+		}
+
+		rb.batch = append(rb.batch, entry)
+	}
+
+	return rb, nil
+}
+
+// RowIterator iterates over a set of rows containing resource data, such as the results of a database query.
+type RowIterator interface {
+	// Next advances to the next row. It returns false when there are no more rows or if iteration failed.
+	Next() bool
+	// Row returns the resource ID and attributes of the current row.
+	Row() (id string, attr map[string]any, err error)
+	// Err returns the error, if any, that was encountered during iteration.
+	Err() error
+}
+
+// BuildBatchFromRows creates a resource batch containing one resource of the given kind for each row,
+// with the given actions to check. Errors from individual rows are accumulated and returned together
+// with the batch containing the rows that were valid.
+func BuildBatchFromRows(actions []string, kind string, rows RowIterator) (*ResourceBatch, error) {
+	rb := NewResourceBatch()
+	var errs error
+
+	for i := 0; rows.Next(); i++ {
+		id, attr, err := rows.Row()
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to read row #%d: %w", i+1, err))
+			continue
+		}
+
+		r := NewResource(kind, id).WithAttributes(attr)
+		if err := r.Err(); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("invalid resource '%s' at row #%d: %w", id, i+1, err))
+			continue
+		}
+
+		rb.Add(r, actions...)
+	}
+
+	if err := rows.Err(); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("failed to iterate rows: %w", err))
+	}
+
+	return rb, multierr.Append(errs, rb.Err())
+}
+
 // Err returns any errors accumulated during the construction of the resource batch.
 func (rb *ResourceBatch) Err() error {
 	return rb.err
@@ -369,9 +1345,50 @@ func (rb *ResourceBatch) Validate() error {
 	return errList
 }
 
+// Len returns the number of entries in the batch.
+func (rb *ResourceBatch) Len() int {
+	return len(rb.batch)
+}
+
+// Entries returns the entries of the batch, with the default scope applied, as they would be sent in a request.
+// The returned slice is a shallow copy: the entries themselves are shared with the batch and should not be modified.
+func (rb *ResourceBatch) Entries() []*requestv1.CheckResourcesRequest_ResourceEntry {
+	entries := rb.entries()
+	out := make([]*requestv1.CheckResourcesRequest_ResourceEntry, len(entries))
+	copy(out, entries)
+
+	return out
+}
+
+// entries returns the batch entries with the default scope applied.
+// Entries are copied before being modified so that the resources added to the batch are left untouched.
+func (rb *ResourceBatch) entries() []*requestv1.CheckResourcesRequest_ResourceEntry {
+	if rb.defaultScope == "" {
+		return rb.batch
+	}
+
+	entries := make([]*requestv1.CheckResourcesRequest_ResourceEntry, len(rb.batch))
+	for i, entry := range rb.batch {
+		if entry.Resource.GetScope() != "" {
+			entries[i] = entry
+			continue
+		}
+
+		resource := proto.Clone(entry.Resource).(*enginev1.Resource)
+		resource.Scope = rb.defaultScope
+		entries[i] = &requestv1.CheckResourcesRequest_ResourceEntry{
+			Actions:  entry.Actions,
+			Resource: resource,
+		}
+	}
+
+	return entries
+}
+
 func (rb *ResourceBatch) toResourceBatchEntry() []*requestv1.CheckResourceBatchRequest_BatchEntry {
-	b := make([]*requestv1.CheckResourceBatchRequest_BatchEntry, len(rb.batch))
-	for i, r := range rb.batch {
+	entries := rb.entries()
+	b := make([]*requestv1.CheckResourceBatchRequest_BatchEntry, len(entries))
+	for i, r := range entries {
 		b[i] = &requestv1.CheckResourceBatchRequest_BatchEntry{
 			Resource: r.Resource,
 			Actions:  r.Actions,
@@ -398,6 +1415,36 @@ func (crbr *CheckResourceBatchResponse) buildIdx() {
 	})
 }
 
+// AllResults returns an iterator over the results in the response, in response order.
+// The batch API only returns the resource ID and the effects, so the other fields of the yielded results are empty.
+// The iterator has the same signature as iter.Seq[*ResourceResult], so it can be used with range-over-func
+// in code built with Go 1.23 or later.
+func (crbr *CheckResourceBatchResponse) AllResults() func(yield func(*ResourceResult) bool) {
+	return func(yield func(*ResourceResult) bool) {
+		for _, r := range crbr.GetResults() {
+			if r == nil {
+				continue
+			}
+
+			entry := &responsev1.CheckResourcesResponse_ResultEntry{
+				Resource:         &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: r.ResourceId},
+				Actions:          r.Actions,
+				ValidationErrors: r.ValidationErrors,
+			}
+
+			if !yield(&ResourceResult{CheckResourcesResponse_ResultEntry: entry}) {
+				return
+			}
+		}
+	}
+}
+
+// ResourceIDs returns the sorted list of distinct resource IDs contained in the response.
+func (crbr *CheckResourceBatchResponse) ResourceIDs() []string {
+	crbr.buildIdx()
+	return sortedKeys(crbr.idx)
+}
+
 // IsAllowed returns true if the given resource and action is allowed.
 // If the resource or the action is not included in the response, the result will always be false.
 func (crbr *CheckResourceBatchResponse) IsAllowed(resourceID, action string) bool {
@@ -464,6 +1511,125 @@ func (rr *ResourceResult) IsAllowed(action string) bool {
 	return false
 }
 
+// Effect returns the effect of the given action.
+// Returns EFFECT_UNSPECIFIED if the action is not in the response or if there was an error getting this result.
+func (rr *ResourceResult) Effect(action string) effectv1.Effect {
+	if rr == nil || rr.err != nil {
+		return effectv1.Effect_EFFECT_UNSPECIFIED
+	}
+
+	return rr.Actions[action]
+}
+
+// EffectiveDerivedRoles returns the derived roles that were activated for the principal while evaluating the resource.
+// They are only included in the response metadata, so the result is empty unless the request sets IncludeMeta.
+// Returns nil if there was an error getting this result.
+func (rr *ResourceResult) EffectiveDerivedRoles() []string {
+	if rr == nil || rr.err != nil {
+		return nil
+	}
+
+	roles := rr.GetMeta().GetEffectiveDerivedRoles()
+	if len(roles) == 0 {
+		return nil
+	}
+
+	out := make([]string, len(roles))
+	copy(out, roles)
+
+	return out
+}
+
+// MatchedPolicy returns the key of the policy that determined the effect of the given action.
+// Returns an empty string if the response doesn't include metadata (see IncludeMeta) or if there was an error getting this result.
+func (rr *ResourceResult) MatchedPolicy(action string) string {
+	if rr == nil || rr.err != nil {
+		return ""
+	}
+
+	return rr.GetMeta().GetActions()[action].GetMatchedPolicy()
+}
+
+// MatchedScope returns the scope of the policy that determined the effect of the given action.
+// Returns an empty string if the response doesn't include metadata (see IncludeMeta) or if there was an error getting this result.
+func (rr *ResourceResult) MatchedScope(action string) string {
+	if rr == nil || rr.err != nil {
+		return ""
+	}
+
+	return rr.GetMeta().GetActions()[action].GetMatchedScope()
+}
+
+// Effects returns a copy of the map of actions to their effects.
+// Returns nil if there was an error getting this result.
+func (rr *ResourceResult) Effects() map[string]effectv1.Effect {
+	if rr == nil || rr.err != nil {
+		return nil
+	}
+
+	effects := make(map[string]effectv1.Effect, len(rr.GetActions()))
+	for action, effect := range rr.GetActions() {
+		effects[action] = effect
+	}
+
+	return effects
+}
+
+// AllowedActions returns the sorted list of actions that are allowed.
+// Returns nil if there was an error getting this result.
+func (rr *ResourceResult) AllowedActions() []string {
+	allowed, _ := rr.partitionActions()
+	return allowed
+}
+
+// DeniedActions returns the sorted list of actions that are not allowed, including those with an unknown effect.
+// Returns nil if there was an error getting this result.
+func (rr *ResourceResult) DeniedActions() []string {
+	_, denied := rr.partitionActions()
+	return denied
+}
+
+func (rr *ResourceResult) partitionActions() (allowed, denied []string) {
+	if rr == nil || rr.err != nil {
+		return nil, nil
+	}
+
+	for action, effect := range rr.Actions {
+		if effect == effectv1.Effect_EFFECT_ALLOW {
+			allowed = append(allowed, action)
+		} else {
+			denied = append(denied, action)
+		}
+	}
+	sort.Strings(allowed)
+	sort.Strings(denied)
+
+	return allowed, denied
+}
+
+// HasUnknownEffect returns true if any action in the result has an effect value that is not known to this version of the client.
+// Such effects are treated as denials by IsAllowed, so this is useful for detecting version skew between the client and the server.
+func (rr *ResourceResult) HasUnknownEffect() bool {
+	return len(rr.UnknownEffectActions()) > 0
+}
+
+// UnknownEffectActions returns the sorted list of actions that have an effect value not known to this version of the client.
+func (rr *ResourceResult) UnknownEffectActions() []string {
+	if rr == nil || rr.err != nil {
+		return nil
+	}
+
+	var actions []string
+	for action, effect := range rr.Actions {
+		if _, ok := effectv1.Effect_name[int32(effect)]; !ok {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+
+	return actions
+}
+
 func (rr *ResourceResult) buildOutputMap() {
 	rr.outputOnce.Do(func() {
 		if len(rr.GetOutputs()) == 0 {
@@ -482,8 +1648,134 @@ func (rr *ResourceResult) Output(key string) *structpb.Value {
 		return nil
 	}
 
-	rr.buildOutputMap()
-	return rr.outputMap[key]
+	rr.buildOutputMap()
+	return rr.outputMap[key]
+}
+
+// OutputValues returns all the outputs in the result converted to Go values, keyed by the rule that produced them.
+// Returns nil if there are no outputs.
+func (rr *ResourceResult) OutputValues() map[string]any {
+	if rr == nil {
+		return nil
+	}
+
+	rr.buildOutputMap()
+	if len(rr.outputMap) == 0 {
+		return nil
+	}
+
+	return attrsFromPB(rr.outputMap)
+}
+
+// OutputInto decodes the output produced by the rule identified by key into dst, which must be a pointer.
+// The output is converted to JSON and decoded using encoding/json, so dst can be a struct with `json` field tags.
+// Returns an error if there was an error getting this result, if the output doesn't exist or if decoding fails.
+func (rr *ResourceResult) OutputInto(key string, dst any) error {
+	if rr == nil {
+		return errors.New("result is nil")
+	}
+
+	if rr.err != nil {
+		return rr.err
+	}
+
+	v := rr.Output(key)
+	if v == nil {
+		return fmt.Errorf("output '%s' does not exist in the result", key)
+	}
+
+	j, err := protojson.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output '%s': %w", key, err)
+	}
+
+	if err := json.Unmarshal(j, dst); err != nil {
+		return fmt.Errorf("failed to decode output '%s': %w", key, err)
+	}
+
+	return nil
+}
+
+// Output decodes the output produced by the rule identified by key into a value of type T, as described in OutputInto.
+// Returns the zero value of T and an error if the output doesn't exist or can't be decoded.
+func Output[T any](rr *ResourceResult, key string) (T, error) {
+	var v T
+	if err := rr.OutputInto(key, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return v, nil
+}
+
+// FirstDenied returns the alphabetically first action that was denied along with the reason for the denial.
+// The reason is the output produced by the rule that denied the action. The response metadata only identifies the policy
+// that decided each action, not the rule, so the reason is only reported when it is unambiguous: the policy produced
+// exactly one output and did not decide any other action in the result. Otherwise, or if metadata was not requested
+// with IncludeMeta, the reason is empty. Returns false if no action was denied or if there was an error getting this result.
+func (rr *ResourceResult) FirstDenied() (action, reason string, ok bool) {
+	if rr == nil || rr.err != nil {
+		return "", "", false
+	}
+
+	actions := make([]string, 0, len(rr.Actions))
+	for a, effect := range rr.Actions {
+		if effect != effectv1.Effect_EFFECT_ALLOW {
+			actions = append(actions, a)
+		}
+	}
+
+	if len(actions) == 0 {
+		return "", "", false
+	}
+
+	sort.Strings(actions)
+	action = actions[0]
+
+	metaActions := rr.GetMeta().GetActions()
+	matchedPolicy := metaActions[action].GetMatchedPolicy()
+	if matchedPolicy == "" {
+		return action, "", true
+	}
+
+	for a, m := range metaActions {
+		if a != action && m.GetMatchedPolicy() == matchedPolicy {
+			return action, "", true
+		}
+	}
+
+	var output *enginev1.OutputEntry
+	for _, o := range rr.GetOutputs() {
+		if strings.HasPrefix(o.GetSrc(), matchedPolicy+"#") {
+			if output != nil {
+				return action, "", true
+			}
+			output = o
+		}
+	}
+
+	if output == nil {
+		return action, "", true
+	}
+
+	return action, outputToString(output.GetVal()), true
+}
+
+func outputToString(v *structpb.Value) string {
+	if v == nil {
+		return ""
+	}
+
+	if s, ok := v.GetKind().(*structpb.Value_StringValue); ok {
+		return s.StringValue
+	}
+
+	b, err := protojson.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
 }
 
 // MatchResource is a function that returns true if the given resource is of interest.
@@ -491,6 +1783,13 @@ func (rr *ResourceResult) Output(key string) *structpb.Value {
 // between them in the response.
 type MatchResource func(*responsev1.CheckResourcesResponse_ResultEntry_Resource) bool
 
+// MatchResourceID is a matcher that checks that the resource ID matches the given value.
+func MatchResourceID(id string) MatchResource {
+	return func(r *responsev1.CheckResourcesResponse_ResultEntry_Resource) bool {
+		return r.Id == id
+	}
+}
+
 // MatchResourceKind is a matcher that checks that the resource kind matches the given value.
 func MatchResourceKind(kind string) MatchResource {
 	return func(r *responsev1.CheckResourcesResponse_ResultEntry_Resource) bool {
@@ -519,6 +1818,39 @@ func MatchResourcePolicyKindScopeVersion(kind, version, scope string) MatchResou
 	}
 }
 
+// MatchAll is a matcher that checks that the resource satisfies all of the given matchers.
+// It matches every resource if no matchers are given.
+func MatchAll(match ...MatchResource) MatchResource {
+	return func(r *responsev1.CheckResourcesResponse_ResultEntry_Resource) bool {
+		for _, m := range match {
+			if !m(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAny is a matcher that checks that the resource satisfies at least one of the given matchers.
+// It doesn't match any resource if no matchers are given.
+func MatchAny(match ...MatchResource) MatchResource {
+	return func(r *responsev1.CheckResourcesResponse_ResultEntry_Resource) bool {
+		for _, m := range match {
+			if m(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchNot is a matcher that checks that the resource does not satisfy the given matcher.
+func MatchNot(match MatchResource) MatchResource {
+	return func(r *responsev1.CheckResourcesResponse_ResultEntry_Resource) bool {
+		return !match(r)
+	}
+}
+
 // CheckResourcesResponse is the response from the CheckResources API call.
 type CheckResourcesResponse struct {
 	*responsev1.CheckResourcesResponse
@@ -526,12 +1858,36 @@ type CheckResourcesResponse struct {
 	once sync.Once
 }
 
+// MergeCheckResourcesResponses combines the results of the given responses, in order, into a new response.
+// This is useful for treating the responses to the chunks of a large batch (see ResourceBatch.Chunk) as one.
+// The request ID is taken from the first response that has one. Nil responses are ignored.
+func MergeCheckResourcesResponses(resps ...*CheckResourcesResponse) *CheckResourcesResponse {
+	merged := &responsev1.CheckResourcesResponse{}
+	for _, r := range resps {
+		if r == nil || r.CheckResourcesResponse == nil {
+			continue
+		}
+
+		if merged.RequestId == "" {
+			merged.RequestId = r.RequestId
+		}
+		merged.Results = append(merged.Results, r.Results...)
+	}
+
+	return &CheckResourcesResponse{CheckResourcesResponse: merged}
+}
+
 func (crr *CheckResourcesResponse) buildIdx() {
 	crr.once.Do(func() {
-		crr.idx = make(map[string][]int, len(crr.Results))
-		for i, r := range crr.Results {
-			v := crr.idx[r.Resource.Id]
-			crr.idx[r.Resource.Id] = append(v, i)
+		results := crr.GetResults()
+		crr.idx = make(map[string][]int, len(results))
+		for i, r := range results {
+			if r == nil {
+				continue
+			}
+
+			id := r.GetResource().GetId()
+			crr.idx[id] = append(crr.idx[id], i)
 		}
 	})
 }
@@ -547,7 +1903,7 @@ func (crr *CheckResourcesResponse) GetResource(resourceID string, match ...Match
 	}
 
 	for _, i := range indexes {
-		r := crr.Results[i]
+		r := crr.GetResults()[i]
 		if r == nil {
 			continue
 		}
@@ -565,13 +1921,282 @@ func (crr *CheckResourcesResponse) GetResource(resourceID string, match ...Match
 	return &ResourceResult{err: fmt.Errorf("resource with ID %q does not exist in the response", resourceID)}
 }
 
+// FindAll returns all results for the resource with the given ID that satisfy the optional properties,
+// in the order they appear in the response. If the resource ID is empty, results for all resources are considered.
+func (crr *CheckResourcesResponse) FindAll(resourceID string, match ...MatchResource) []*ResourceResult {
+	var candidates []int
+	if resourceID == "" {
+		candidates = make([]int, len(crr.GetResults()))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	} else {
+		crr.buildIdx()
+		candidates = crr.idx[resourceID]
+	}
+
+	var results []*ResourceResult
+	for _, i := range candidates {
+		r := crr.GetResults()[i]
+		if r == nil {
+			continue
+		}
+
+		found := true
+		for _, m := range match {
+			found = found && m(r.Resource)
+		}
+
+		if found {
+			results = append(results, &ResourceResult{CheckResourcesResponse_ResultEntry: r})
+		}
+	}
+
+	return results
+}
+
+// CommonAllowedActions returns the sorted list of actions that are allowed on all of the resources with the given IDs.
+// If any of the resources is not contained in the response, the result will be empty.
+func (crr *CheckResourcesResponse) CommonAllowedActions(resourceIDs ...string) []string {
+	if len(resourceIDs) == 0 {
+		return nil
+	}
+
+	var common map[string]struct{}
+	for _, id := range resourceIDs {
+		rr := crr.GetResource(id)
+		if rr.Err() != nil {
+			return nil
+		}
+
+		allowed := make(map[string]struct{}, len(rr.Actions))
+		for action, effect := range rr.Actions {
+			if effect != effectv1.Effect_EFFECT_ALLOW {
+				continue
+			}
+
+			if _, ok := common[action]; common == nil || ok {
+				allowed[action] = struct{}{}
+			}
+		}
+
+		common = allowed
+		if len(common) == 0 {
+			return nil
+		}
+	}
+
+	actions := make([]string, 0, len(common))
+	for action := range common {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	return actions
+}
+
+// ByKind groups the results by resource kind. Results in each group are in the same order as the response.
+func (crr *CheckResourcesResponse) ByKind() map[string][]*ResourceResult {
+	groups := make(map[string][]*ResourceResult)
+	for _, r := range crr.GetResults() {
+		if r == nil {
+			continue
+		}
+
+		kind := r.Resource.GetKind()
+		groups[kind] = append(groups[kind], &ResourceResult{CheckResourcesResponse_ResultEntry: r})
+	}
+
+	return groups
+}
+
+// AllowedResources returns the IDs of the resources for which the given action is allowed, in response order.
+// If the same ID appears more than once in the response, the affected resources are identified as `kind/id` instead.
+func (crr *CheckResourcesResponse) AllowedResources(action string) []string {
+	crr.buildIdx()
+
+	var ids []string
+	for _, r := range crr.GetResults() {
+		if r == nil || r.Actions[action] != effectv1.Effect_EFFECT_ALLOW {
+			continue
+		}
+
+		ids = append(ids, crr.resultID(r))
+	}
+
+	return ids
+}
+
+// AllResults returns an iterator over the results in the response, in response order.
+// The iterator has the same signature as iter.Seq[*ResourceResult], so it can be used with range-over-func
+// in code built with Go 1.23 or later.
+func (crr *CheckResourcesResponse) AllResults() func(yield func(*ResourceResult) bool) {
+	return func(yield func(*ResourceResult) bool) {
+		for _, r := range crr.GetResults() {
+			if r == nil {
+				continue
+			}
+
+			if !yield(&ResourceResult{CheckResourcesResponse_ResultEntry: r}) {
+				return
+			}
+		}
+	}
+}
+
+// ResourceIDs returns the sorted list of distinct resource IDs contained in the response.
+func (crr *CheckResourcesResponse) ResourceIDs() []string {
+	crr.buildIdx()
+	return sortedKeys(crr.idx)
+}
+
+// FilterAllowed returns the IDs of the resources that satisfy the optional properties and for which the given action
+// is allowed, in response order. Unlike AllowedResources, the IDs are returned as is, so matchers should be used to
+// narrow down the results if the same ID can appear more than once in the response.
+func (crr *CheckResourcesResponse) FilterAllowed(action string, match ...MatchResource) []string {
+	var ids []string
+	for _, rr := range crr.FindAll("", match...) {
+		if rr.IsAllowed(action) {
+			ids = append(ids, rr.Resource.GetId())
+		}
+	}
+
+	return ids
+}
+
+// Fingerprint returns a hash of the decisions in the response that is suitable for comparing responses in tests.
+// Only the identity of each resource, the effects of the actions and the outputs are taken into account,
+// and the order of the results and outputs in the response doesn't affect the value.
+func (crr *CheckResourcesResponse) Fingerprint() string {
+	entries := make([]string, 0, len(crr.GetResults()))
+	for _, r := range crr.GetResults() {
+		actions := make(map[string]string, len(r.GetActions()))
+		for action, effect := range r.GetActions() {
+			actions[action] = effect.String()
+		}
+
+		outputs := make([]string, len(r.GetOutputs()))
+		for i, o := range r.GetOutputs() {
+			val, _ := json.Marshal(o.GetVal().AsInterface())
+			outputs[i] = o.GetSrc() + "=" + string(val)
+		}
+		sort.Strings(outputs)
+
+		res := r.GetResource()
+		// Marshaling a map of strings and slices of strings can't fail, and encoding/json sorts the map keys.
+		entry, _ := json.Marshal(map[string]any{
+			"kind":          res.GetKind(),
+			"id":            res.GetId(),
+			"policyVersion": res.GetPolicyVersion(),
+			"scope":         res.GetScope(),
+			"actions":       actions,
+			"outputs":       outputs,
+		})
+		entries = append(entries, string(entry))
+	}
+	sort.Strings(entries)
+
+	return fmt.Sprintf("%016x", util.HashStr(strings.Join(entries, "\n")))
+}
+
+// VersionMismatches returns the IDs of the resources that were evaluated against a policy version other than expected,
+// in response order. Resources are identified in the same way as AllowedResources.
+func (crr *CheckResourcesResponse) VersionMismatches(expected string) []string {
+	crr.buildIdx()
+
+	var ids []string
+	for _, r := range crr.GetResults() {
+		if r == nil || r.GetResource().GetPolicyVersion() == expected {
+			continue
+		}
+
+		ids = append(ids, crr.resultID(r))
+	}
+
+	return ids
+}
+
+func (crr *CheckResourcesResponse) resultID(r *responsev1.CheckResourcesResponse_ResultEntry) string {
+	id := r.GetResource().GetId()
+	if len(crr.idx[id]) > 1 {
+		return r.GetResource().GetKind() + "/" + id
+	}
+
+	return id
+}
+
+// MaskActions returns a copy of the response where the actions of each result, including the action metadata,
+// are restricted to the given set of actions. Outputs are only kept if they were produced by a policy that decided
+// a retained action and no masked action, so outputs are dropped altogether if the response has no metadata
+// (see IncludeMeta). The original response is not modified.
+func (crr *CheckResourcesResponse) MaskActions(allowed ...string) *CheckResourcesResponse {
+	if crr == nil || crr.CheckResourcesResponse == nil {
+		return &CheckResourcesResponse{}
+	}
+
+	keep := make(map[string]struct{}, len(allowed))
+	for _, a := range allowed {
+		keep[a] = struct{}{}
+	}
+
+	masked := proto.Clone(crr.CheckResourcesResponse).(*responsev1.CheckResourcesResponse)
+	for _, r := range masked.Results {
+		r.Outputs = maskOutputs(r, keep)
+
+		for action := range r.GetActions() {
+			if _, ok := keep[action]; !ok {
+				delete(r.Actions, action)
+			}
+		}
+
+		for action := range r.GetMeta().GetActions() {
+			if _, ok := keep[action]; !ok {
+				delete(r.Meta.Actions, action)
+			}
+		}
+	}
+
+	return &CheckResourcesResponse{CheckResourcesResponse: masked}
+}
+
+// maskOutputs returns the outputs of the result that can be attributed to the retained actions.
+func maskOutputs(r *responsev1.CheckResourcesResponse_ResultEntry, keep map[string]struct{}) []*enginev1.OutputEntry {
+	if len(r.GetOutputs()) == 0 {
+		return r.GetOutputs()
+	}
+
+	retainedPolicies := make(map[string]bool)
+	for action, m := range r.GetMeta().GetActions() {
+		policy := m.GetMatchedPolicy()
+		if policy == "" {
+			continue
+		}
+
+		_, retained := keep[action]
+		if allowed, ok := retainedPolicies[policy]; ok {
+			retainedPolicies[policy] = allowed && retained
+		} else {
+			retainedPolicies[policy] = retained
+		}
+	}
+
+	var outputs []*enginev1.OutputEntry
+	for _, o := range r.GetOutputs() {
+		if policy, _, ok := strings.Cut(o.GetSrc(), "#"); ok && retainedPolicies[policy] {
+			outputs = append(outputs, o)
+		}
+	}
+
+	return outputs
+}
+
 // Errors returns any validation errors returned by the server.
 func (crr *CheckResourcesResponse) Errors() error {
 	var err error
-	for _, result := range crr.Results {
-		for _, verr := range result.ValidationErrors {
+	for _, result := range crr.GetResults() {
+		for _, verr := range result.GetValidationErrors() {
 			err = multierr.Append(err,
-				fmt.Errorf("resource %q failed validation: source=%s path=%s msg=%s", result.Resource.Id, verr.Source, verr.Path, verr.Message),
+				fmt.Errorf("resource %q failed validation: source=%s path=%s msg=%s", result.GetResource().GetId(), verr.Source, verr.Path, verr.Message),
 			)
 		}
 	}
@@ -579,6 +2204,25 @@ func (crr *CheckResourcesResponse) Errors() error {
 	return err
 }
 
+// Partition splits the results in the response into those that passed validation and those that have validation errors.
+// The results are returned in response order.
+func (crr *CheckResourcesResponse) Partition() (valid, invalid []*ResourceResult) {
+	for _, r := range crr.GetResults() {
+		if r == nil {
+			continue
+		}
+
+		rr := &ResourceResult{CheckResourcesResponse_ResultEntry: r}
+		if len(r.GetValidationErrors()) > 0 {
+			invalid = append(invalid, rr)
+		} else {
+			valid = append(valid, rr)
+		}
+	}
+
+	return valid, invalid
+}
+
 func (crr *CheckResourcesResponse) String() string {
 	return protojson.Format(crr.CheckResourcesResponse)
 }
@@ -587,6 +2231,100 @@ func (crr *CheckResourcesResponse) MarshalJSON() ([]byte, error) {
 	return protojson.Marshal(crr.CheckResourcesResponse)
 }
 
+// ReadPolicyRejectDeprecated reads a policy from the given reader and returns an error listing
+// any deprecated fields that are set in the policy.
+func ReadPolicyRejectDeprecated(r io.Reader) (*policyv1.Policy, error) {
+	p, err := policy.ReadPolicy(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	if fields := policy.DeprecatedFields(p); len(fields) > 0 {
+		return nil, fmt.Errorf("policy uses deprecated fields: %s", strings.Join(fields, ", "))
+	}
+
+	return p, nil
+}
+
+// ReadPolicyVerified reads a policy from the given reader and checks that its hash matches the expected value.
+// The hash is always computed from the policy contents, so a hash embedded in the policy metadata is not trusted.
+func ReadPolicyVerified(r io.Reader, expectedHash uint64) (*policyv1.Policy, error) {
+	p, err := policy.ReadPolicy(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	if hash := policy.GetHash(policy.WithHash(p)); hash != expectedHash {
+		return nil, fmt.Errorf("policy hash mismatch: expected %d, got %d", expectedHash, hash)
+	}
+
+	return p, nil
+}
+
+var envPlaceholderRegex = regexp.MustCompile(`\$\{ENV:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// yamlSpecialChars are the characters that can change the structure of a YAML document when they appear in
+// an interpolated value, for example by closing a quoted scalar or starting a new mapping entry.
+const yamlSpecialChars = "\"'\\:#{}[],&*!|>%@`"
+
+// ReadPolicyInterpolated reads a policy from the given reader after replacing each `${ENV:NAME}` placeholder
+// with the value of NAME from vars. An error is returned if any placeholder has no value in vars, or if a value
+// contains control characters (including newlines) or characters with a special meaning in YAML, because they
+// could otherwise alter the structure of the policy.
+func ReadPolicyInterpolated(r io.Reader, vars map[string]string) (*policyv1.Policy, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	var unresolved, unsafe []string
+	seen := make(map[string]struct{})
+	rendered := envPlaceholderRegex.ReplaceAllFunc(contents, func(m []byte) []byte {
+		name := string(envPlaceholderRegex.FindSubmatch(m)[1])
+		v, ok := vars[name]
+		if ok && isSafeYAMLValue(v) {
+			return []byte(v)
+		}
+
+		if _, done := seen[name]; !done {
+			seen[name] = struct{}{}
+			if ok {
+				unsafe = append(unsafe, name)
+			} else {
+				unresolved = append(unresolved, name)
+			}
+		}
+		return m
+	})
+
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		return nil, fmt.Errorf("unresolved placeholders in policy: %s", strings.Join(unresolved, ", "))
+	}
+
+	if len(unsafe) > 0 {
+		sort.Strings(unsafe)
+		return nil, fmt.Errorf("values of placeholders contain characters that are not allowed in policies: %s", strings.Join(unsafe, ", "))
+	}
+
+	p, err := policy.ReadPolicy(bytes.NewReader(rendered))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	return p, nil
+}
+
+func isSafeYAMLValue(v string) bool {
+	for _, c := range v {
+		if unicode.IsControl(c) || strings.ContainsRune(yamlSpecialChars, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // PolicySet is a container for a set of policies.
 type PolicySet struct {
 	err      error
@@ -714,6 +2452,87 @@ func (ps *PolicySet) Size() int {
 	return len(ps.policies)
 }
 
+// Scopes returns the sorted, de-duplicated list of scopes declared by the resource and principal policies in the set.
+// The root scope is represented by the empty string.
+func (ps *PolicySet) Scopes() []string {
+	seen := make(map[string]struct{})
+	for _, p := range ps.policies {
+		switch p.PolicyType.(type) {
+		case *policyv1.Policy_ResourcePolicy, *policyv1.Policy_PrincipalPolicy:
+			seen[policy.GetScope(p)] = struct{}{}
+		}
+	}
+
+	scopes := make([]string, 0, len(seen))
+	for s := range seen {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	return scopes
+}
+
+// CoveredKinds returns the sorted, de-duplicated list of resource kinds that have at least one resource policy in the set.
+func (ps *PolicySet) CoveredKinds() []string {
+	seen := make(map[string]struct{})
+	for _, p := range ps.policies {
+		if rp := p.GetResourcePolicy(); rp != nil {
+			seen[rp.Resource] = struct{}{}
+		}
+	}
+
+	kinds := make([]string, 0, len(seen))
+	for k := range seen {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	return kinds
+}
+
+// HasPolicyForKind returns true if the set contains at least one resource policy for the given resource kind.
+func (ps *PolicySet) HasPolicyForKind(kind string) bool {
+	for _, p := range ps.policies {
+		if rp := p.GetResourcePolicy(); rp != nil && rp.Resource == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterByLabel returns a new policy set containing the policies in this set that have the given label.
+// Labels are read from the annotations in the policy metadata.
+func (ps *PolicySet) FilterByLabel(key, value string) *PolicySet {
+	filtered := NewPolicySet()
+	for _, p := range ps.policies {
+		if v, ok := p.GetMetadata().GetAnnotations()[key]; ok && v == value {
+			filtered.policies = append(filtered.policies, p)
+		}
+	}
+
+	return filtered
+}
+
+// PoliciesReferencingSchema returns the sorted list of fully-qualified names of the resource policies in the set
+// whose principal or resource schema is the given schema reference.
+func (ps *PolicySet) PoliciesReferencingSchema(schemaRef string) []string {
+	var fqns []string
+	for _, p := range ps.policies {
+		rp := p.GetResourcePolicy()
+		if rp == nil {
+			continue
+		}
+
+		if rp.Schemas.GetPrincipalSchema().GetRef() == schemaRef || rp.Schemas.GetResourceSchema().GetRef() == schemaRef {
+			fqns = append(fqns, namer.FQN(p))
+		}
+	}
+	sort.Strings(fqns)
+
+	return fqns
+}
+
 func (ps *PolicySet) add(b interface {
 	build() (*policyv1.Policy, error)
 },
@@ -745,6 +2564,90 @@ func (ps *PolicySet) Validate() error {
 	return nil
 }
 
+// ExprLocation identifies a CEL expression in a policy.
+type ExprLocation struct {
+	// FQN is the fully-qualified name of the policy containing the expression.
+	FQN string
+	// RuleName is the name of the rule, derived role or variable the expression belongs to.
+	RuleName string
+	// Expr is the expression.
+	Expr string
+}
+
+// AllExpressions returns the CEL expressions of all policies in the set. For each policy, the condition and output
+// expressions of its rules and derived roles are returned first, followed by its variable definitions.
+func (ps *PolicySet) AllExpressions() []ExprLocation {
+	var locs []ExprLocation
+	for _, p := range ps.policies {
+		fqn := namer.FQN(p)
+		for _, re := range append(ruleExprs(p), variableExprs(p)...) {
+			locs = append(locs, ExprLocation{FQN: fqn, RuleName: re.rule, Expr: re.expr})
+		}
+	}
+
+	return locs
+}
+
+// ValidateAll validates each policy in the set using the given profile. The errors are combined in the order of the
+// fully-qualified names of the policies they belong to.
+func (ps *PolicySet) ValidateAll(profile ValidationProfile) error {
+	return ps.validateAll(1, profile)
+}
+
+// ValidateAllParallel validates each policy in the set, including compiling its condition and output expressions,
+// using the given number of concurrent workers. If concurrency is not positive, one worker per CPU is used.
+// Policies are validated using the ServerCompatible profile.
+// The errors are combined in the order of the fully-qualified names of the policies they belong to.
+func (ps *PolicySet) ValidateAllParallel(concurrency int) error {
+	return ps.validateAll(concurrency, ServerCompatible)
+}
+
+func (ps *PolicySet) validateAll(concurrency int, profile ValidationProfile) error {
+	if err := ps.Validate(); err != nil {
+		return err
+	}
+
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	type result struct {
+		err error
+		fqn string
+	}
+
+	results := make([]result, len(ps.policies))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				p := ps.policies[idx]
+				results[idx] = result{fqn: namer.FQN(p), err: ValidatePolicy(p, profile)}
+			}
+		}()
+	}
+
+	for i := range ps.policies {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].fqn < results[j].fqn })
+
+	var err error
+	for _, r := range results {
+		if r.err != nil {
+			err = multierr.Append(err, fmt.Errorf("invalid policy '%s': %w", r.fqn, r.err))
+		}
+	}
+
+	return err
+}
+
 // SchemaSet is a container for a set of schemas.
 type SchemaSet struct {
 	err     error
@@ -832,6 +2735,116 @@ func (ss *SchemaSet) Err() error {
 	return ss.err
 }
 
+// Bundle is a set of policies and the schemas they reference that are validated together as a unit.
+type Bundle struct {
+	policies *PolicySet
+	schemas  *SchemaSet
+}
+
+// NewBundle creates a new bundle from the given policy set and schema set.
+func NewBundle(policies *PolicySet, schemas *SchemaSet) *Bundle {
+	if policies == nil {
+		policies = NewPolicySet()
+	}
+
+	if schemas == nil {
+		schemas = NewSchemaSet()
+	}
+
+	return &Bundle{policies: policies, schemas: schemas}
+}
+
+// Policies returns the policy set of the bundle.
+func (b *Bundle) Policies() *PolicySet {
+	return b.policies
+}
+
+// Schemas returns the schema set of the bundle.
+func (b *Bundle) Schemas() *SchemaSet {
+	return b.schemas
+}
+
+// Validate checks whether the policy set and schema set are valid and consistent with each other.
+// In addition to the checks done by each set, it verifies that no two policies have the same fully-qualified name,
+// that every schema reference using the cerbos scheme resolves to a schema in the bundle
+// and that every imported derived roles or exported variables policy is present in the bundle.
+func (b *Bundle) Validate() error {
+	err := multierr.Append(b.policies.Validate(), b.schemas.Err())
+
+	schemaIDs := make(map[string]struct{}, b.schemas.Size())
+	for _, s := range b.schemas.GetSchemas() {
+		schemaIDs[s.GetId()] = struct{}{}
+	}
+
+	derivedRoles := make(map[string]struct{})
+	exportVariables := make(map[string]struct{})
+	fqns := make(map[string]struct{}, b.policies.Size())
+	for _, p := range b.policies.GetPolicies() {
+		fqn := namer.FQN(p)
+		if _, ok := fqns[fqn]; ok {
+			err = multierr.Append(err, fmt.Errorf("duplicate policy '%s'", fqn))
+		}
+		fqns[fqn] = struct{}{}
+
+		switch pt := p.PolicyType.(type) {
+		case *policyv1.Policy_DerivedRoles:
+			derivedRoles[pt.DerivedRoles.GetName()] = struct{}{}
+		case *policyv1.Policy_ExportVariables:
+			exportVariables[pt.ExportVariables.GetName()] = struct{}{}
+		}
+	}
+
+	checkSchema := func(fqn string, s *policyv1.Schemas_Schema) {
+		ref := s.GetRef()
+		if ref == "" {
+			return
+		}
+
+		u, perr := url.Parse(ref)
+		if perr != nil {
+			err = multierr.Append(err, fmt.Errorf("policy '%s' has an invalid schema reference '%s': %w", fqn, ref, perr))
+			return
+		}
+
+		if u.Scheme != "" && u.Scheme != schema.URLScheme {
+			return
+		}
+
+		if _, ok := schemaIDs[strings.TrimPrefix(u.Path, "/")]; !ok {
+			err = multierr.Append(err, fmt.Errorf("policy '%s' references schema '%s' which is not in the bundle", fqn, ref))
+		}
+	}
+
+	checkVariables := func(fqn string, v *policyv1.Variables) {
+		for _, name := range v.GetImport() {
+			if _, ok := exportVariables[name]; !ok {
+				err = multierr.Append(err, fmt.Errorf("policy '%s' imports variables '%s' which are not in the bundle", fqn, name))
+			}
+		}
+	}
+
+	for _, p := range b.policies.GetPolicies() {
+		fqn := namer.FQN(p)
+		switch pt := p.PolicyType.(type) {
+		case *policyv1.Policy_ResourcePolicy:
+			checkSchema(fqn, pt.ResourcePolicy.GetSchemas().GetPrincipalSchema())
+			checkSchema(fqn, pt.ResourcePolicy.GetSchemas().GetResourceSchema())
+			checkVariables(fqn, pt.ResourcePolicy.GetVariables())
+			for _, name := range pt.ResourcePolicy.GetImportDerivedRoles() {
+				if _, ok := derivedRoles[name]; !ok {
+					err = multierr.Append(err, fmt.Errorf("policy '%s' imports derived roles '%s' which are not in the bundle", fqn, name))
+				}
+			}
+		case *policyv1.Policy_PrincipalPolicy:
+			checkVariables(fqn, pt.PrincipalPolicy.GetVariables())
+		case *policyv1.Policy_DerivedRoles:
+			checkVariables(fqn, pt.DerivedRoles.GetVariables())
+		}
+	}
+
+	return err
+}
+
 // Schema is a builder for Schemas_Schema.
 type Schema struct {
 	s *policyv1.Schemas_Schema
@@ -868,8 +2881,10 @@ func (s *Schema) build() *policyv1.Schemas_Schema {
 
 // ResourcePolicy is a builder for resource policies.
 type ResourcePolicy struct {
-	p   *policyv1.ResourcePolicy
-	err error
+	p        *policyv1.ResourcePolicy
+	err      error
+	metadata *policyv1.Metadata
+	disabled bool
 }
 
 // NewResourcePolicy creates a new resource policy builder.
@@ -883,27 +2898,168 @@ func NewResourcePolicy(resource, version string) *ResourcePolicy {
 	}
 }
 
+// NewDenyAllResourcePolicy creates a resource policy builder with a single rule that DENIES all actions for all roles.
+// It is intended to be used as a safe starting point for new resource kinds.
+func NewDenyAllResourcePolicy(resource, version string) *ResourcePolicy {
+	return NewResourcePolicy(resource, version).
+		AddResourceRules(NewDenyResourceRule("*").WithRoles("*"))
+}
+
+// NewAllowAllResourcePolicy creates a resource policy builder with a single rule that ALLOWS all actions for all roles.
+// It grants unrestricted access and should only be used for internal or fully trusted resource kinds.
+func NewAllowAllResourcePolicy(resource, version string) *ResourcePolicy {
+	return NewResourcePolicy(resource, version).
+		AddResourceRules(NewAllowResourceRule("*").WithRoles("*"))
+}
+
 // WithDerivedRolesImports adds import statements for derived roles.
 func (rp *ResourcePolicy) WithDerivedRolesImports(imp ...string) *ResourcePolicy {
 	rp.p.ImportDerivedRoles = append(rp.p.ImportDerivedRoles, imp...)
 	return rp
 }
 
+// WithDisabled sets whether the policy is disabled. Disabled policies are not used for evaluating requests.
+func (rp *ResourcePolicy) WithDisabled(disabled bool) *ResourcePolicy {
+	rp.disabled = disabled
+	return rp
+}
+
 func (rp *ResourcePolicy) WithScope(scope string) *ResourcePolicy {
 	rp.p.Scope = scope
 	return rp
 }
 
 func (rp *ResourcePolicy) WithPrincipalSchema(principalSchema *Schema) *ResourcePolicy {
+	if rp.p.Schemas == nil {
+		rp.p.Schemas = &policyv1.Schemas{}
+	}
 	rp.p.Schemas.PrincipalSchema = principalSchema.build()
 	return rp
 }
 
 func (rp *ResourcePolicy) WithResourceSchema(resourceSchema *Schema) *ResourcePolicy {
+	if rp.p.Schemas == nil {
+		rp.p.Schemas = &policyv1.Schemas{}
+	}
 	rp.p.Schemas.ResourceSchema = resourceSchema.build()
 	return rp
 }
 
+// WithLabel adds a label to the policy. Labels are stored as annotations in the policy metadata.
+func (rp *ResourcePolicy) WithLabel(key, value string) *ResourcePolicy {
+	if rp.metadata == nil {
+		rp.metadata = &policyv1.Metadata{}
+	}
+
+	if rp.metadata.Annotations == nil {
+		rp.metadata.Annotations = make(map[string]string)
+	}
+
+	rp.metadata.Annotations[key] = value
+	return rp
+}
+
+// ValidateSchemaIgnoreActions checks that every action listed in the ignoreWhen block of the principal and resource schemas
+// matches an action referenced by at least one of the rules in the policy. Globs are taken into account in both directions.
+func (rp *ResourcePolicy) ValidateSchemaIgnoreActions() error {
+	var ruleActions []string
+	for _, rule := range rp.p.Rules {
+		ruleActions = append(ruleActions, rule.Actions...)
+	}
+
+	covered := func(action string) bool {
+		for _, ra := range ruleActions {
+			if len(util.FilterGlob(ra, []string{action})) > 0 || len(util.FilterGlob(action, []string{ra})) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var err error
+	check := func(kind string, s *policyv1.Schemas_Schema) {
+		for _, action := range s.GetIgnoreWhen().GetActions() {
+			if !covered(action) {
+				err = multierr.Append(err, fmt.Errorf("%s schema ignores action '%s' which is not referenced by any rule", kind, action))
+			}
+		}
+	}
+
+	check("principal", rp.p.Schemas.GetPrincipalSchema())
+	check("resource", rp.p.Schemas.GetResourceSchema())
+
+	return err
+}
+
+// ActionsByRole returns a map of each role and derived role referenced by the ALLOW rules of the policy
+// to the sorted list of actions those rules allow. Rule conditions are ignored, so the result is a static
+// over-approximation: a role may not actually be allowed to perform an action if the rule's condition is not satisfied.
+func (rp *ResourcePolicy) ActionsByRole() map[string][]string {
+	actionSets := make(map[string]map[string]struct{})
+	for _, rule := range rp.p.Rules {
+		if rule.Effect != effectv1.Effect_EFFECT_ALLOW {
+			continue
+		}
+
+		for _, role := range append(append([]string{}, rule.Roles...), rule.DerivedRoles...) {
+			set, ok := actionSets[role]
+			if !ok {
+				set = make(map[string]struct{})
+				actionSets[role] = set
+			}
+
+			for _, action := range rule.Actions {
+				set[action] = struct{}{}
+			}
+		}
+	}
+
+	result := make(map[string][]string, len(actionSets))
+	for role, set := range actionSets {
+		actions := make([]string, 0, len(set))
+		for action := range set {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		result[role] = actions
+	}
+
+	return result
+}
+
+// RolesForAction returns the sorted list of roles and derived roles referenced by the ALLOW rules of the policy
+// that match the given action. Action globs in rules are taken into account but rule conditions are ignored.
+func (rp *ResourcePolicy) RolesForAction(action string) []string {
+	seen := make(map[string]struct{})
+	for _, rule := range rp.p.Rules {
+		if rule.Effect != effectv1.Effect_EFFECT_ALLOW {
+			continue
+		}
+
+		for _, a := range rule.Actions {
+			if len(util.FilterGlob(a, []string{action})) == 0 {
+				continue
+			}
+
+			for _, role := range rule.Roles {
+				seen[role] = struct{}{}
+			}
+			for _, role := range rule.DerivedRoles {
+				seen[role] = struct{}{}
+			}
+			break
+		}
+	}
+
+	roles := make([]string, 0, len(seen))
+	for role := range seen {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return roles
+}
+
 // AddResourceRules adds resource rules to the policy.
 func (rp *ResourcePolicy) AddResourceRules(rules ...*ResourceRule) *ResourcePolicy {
 	for _, r := range rules {
@@ -922,6 +3078,30 @@ func (rp *ResourcePolicy) AddResourceRules(rules ...*ResourceRule) *ResourcePoli
 	return rp
 }
 
+// AddRulesForRoles adds resource rules to the policy after adding the given roles to each rule.
+// Roles that are already present on a rule are not duplicated.
+func (rp *ResourcePolicy) AddRulesForRoles(roles []string, rules ...*ResourceRule) *ResourcePolicy {
+	for _, r := range rules {
+		if r == nil {
+			continue
+		}
+
+		existing := make(map[string]struct{}, len(r.rule.Roles))
+		for _, role := range r.rule.Roles {
+			existing[role] = struct{}{}
+		}
+
+		for _, role := range roles {
+			if _, ok := existing[role]; !ok {
+				existing[role] = struct{}{}
+				r.rule.Roles = append(r.rule.Roles, role)
+			}
+		}
+	}
+
+	return rp.AddResourceRules(rules...)
+}
+
 // WithVariablesImports adds import statements for exported variables.
 func (rp *ResourcePolicy) WithVariablesImports(name ...string) *ResourcePolicy {
 	rp.p.Variables.Import = append(rp.p.Variables.Import, name...)
@@ -934,6 +3114,18 @@ func (rp *ResourcePolicy) WithVariable(name, expr string) *ResourcePolicy {
 	return rp
 }
 
+// ValidateImportsAgainst checks that every exported variables set imported by the policy is present in the given registry.
+func (rp *ResourcePolicy) ValidateImportsAgainst(registry map[string]bool) error {
+	var err error
+	for _, name := range rp.p.Variables.GetImport() {
+		if !registry[name] {
+			err = multierr.Append(err, fmt.Errorf("policy imports unknown exported variables '%s'", name))
+		}
+	}
+
+	return err
+}
+
 // Err returns any errors accumulated during the construction of the policy.
 func (rp *ResourcePolicy) Err() error {
 	return rp.err
@@ -952,9 +3144,11 @@ func (rp *ResourcePolicy) Validate() error {
 func (rp *ResourcePolicy) build() (*policyv1.Policy, error) {
 	p := &policyv1.Policy{
 		ApiVersion: apiVersion,
+		Disabled:   rp.disabled,
 		PolicyType: &policyv1.Policy_ResourcePolicy{
 			ResourcePolicy: rp.p,
 		},
+		Metadata: rp.metadata,
 	}
 
 	return p, policy.Validate(p)
@@ -962,7 +3156,9 @@ func (rp *ResourcePolicy) build() (*policyv1.Policy, error) {
 
 // ResourceRule is a rule in a resource policy.
 type ResourceRule struct {
-	rule *policyv1.ResourceRule
+	rule       *policyv1.ResourceRule
+	err        error
+	autoOutput bool
 }
 
 // NewAllowResourceRule creates a resource rule that allows the actions when matched.
@@ -988,6 +3184,41 @@ func NewDenyResourceRule(actions ...string) *ResourceRule {
 // WithName sets the name of the ResourceRule.
 func (rr *ResourceRule) WithName(name string) *ResourceRule {
 	rr.rule.Name = name
+	if rr.autoOutput {
+		rr.setAutoOutput()
+	}
+	return rr
+}
+
+// WithAutoOutput sets the output of the rule to a map containing the rule name and effect.
+// For example, a deny rule named owner-can-edit produces the output {"rule": "owner-can-edit", "effect": "deny"}.
+func (rr *ResourceRule) WithAutoOutput() *ResourceRule {
+	rr.autoOutput = true
+	rr.setAutoOutput()
+	return rr
+}
+
+func (rr *ResourceRule) setAutoOutput() {
+	effect := "deny"
+	if rr.rule.Effect == effectv1.Effect_EFFECT_ALLOW {
+		effect = "allow"
+	}
+
+	rr.rule.Output = &policyv1.Output{
+		Expr: fmt.Sprintf(`{"rule": %s, "effect": %q}`, strconv.Quote(rr.rule.Name), effect),
+	}
+}
+
+// WithOutput sets the expression that is evaluated to produce the output of the rule when it is activated.
+// It replaces any output set by WithAutoOutput.
+func (rr *ResourceRule) WithOutput(expr string) *ResourceRule {
+	if expr == "" {
+		rr.err = multierr.Append(rr.err, errors.New("output expression must not be empty"))
+		return rr
+	}
+
+	rr.autoOutput = false
+	rr.rule.Output = &policyv1.Output{Expr: expr}
 	return rr
 }
 
@@ -1016,18 +3247,23 @@ func (rr *ResourceRule) WithCondition(m match) *ResourceRule {
 
 // Err returns errors accumulated during the construction of the resource rule.
 func (rr *ResourceRule) Err() error {
-	return nil
+	return rr.err
 }
 
 // Validate checks whether the resource rule is valid.
 func (rr *ResourceRule) Validate() error {
+	if rr.err != nil {
+		return rr.err
+	}
+
 	return rr.rule.Validate()
 }
 
 // PrincipalPolicy is a builder for principal policies.
 type PrincipalPolicy struct {
-	pp  *policyv1.PrincipalPolicy
-	err error
+	pp       *policyv1.PrincipalPolicy
+	err      error
+	disabled bool
 }
 
 // NewPrincipalPolicy creates a new principal policy.
@@ -1059,6 +3295,12 @@ func (pp *PrincipalPolicy) AddPrincipalRules(rules ...*PrincipalRule) *Principal
 	return pp
 }
 
+// WithDisabled sets whether the policy is disabled. Disabled policies are not used for evaluating requests.
+func (pp *PrincipalPolicy) WithDisabled(disabled bool) *PrincipalPolicy {
+	pp.disabled = disabled
+	return pp
+}
+
 // WithScope sets the scope of this policy.
 func (pp *PrincipalPolicy) WithScope(scope string) *PrincipalPolicy {
 	pp.pp.Scope = scope
@@ -1101,6 +3343,7 @@ func (pp *PrincipalPolicy) Validate() error {
 func (pp *PrincipalPolicy) build() (*policyv1.Policy, error) {
 	p := &policyv1.Policy{
 		ApiVersion: apiVersion,
+		Disabled:   pp.disabled,
 		PolicyType: &policyv1.Policy_PrincipalPolicy{
 			PrincipalPolicy: pp.pp,
 		},
@@ -1112,6 +3355,7 @@ func (pp *PrincipalPolicy) build() (*policyv1.Policy, error) {
 // PrincipalRule is a builder for principal rules.
 type PrincipalRule struct {
 	rule *policyv1.PrincipalRule
+	err  error
 }
 
 // NewPrincipalRule creates a new rule for the specified resource.
@@ -1145,6 +3389,38 @@ func (pr *PrincipalRule) DenyActionOnCondition(action string, m match) *Principa
 	return pr.addAction(action, effectv1.Effect_EFFECT_DENY, cond)
 }
 
+// AllowActionWithOutput sets the action as allowed and sets the expression that is evaluated to produce the output
+// when the action rule is activated. If conditions are given, the action is only allowed if all of them are fulfilled.
+func (pr *PrincipalRule) AllowActionWithOutput(action, outputExpr string, m ...match) *PrincipalRule {
+	return pr.addActionWithOutput(action, effectv1.Effect_EFFECT_ALLOW, outputExpr, m)
+}
+
+// DenyActionWithOutput sets the action as denied and sets the expression that is evaluated to produce the output
+// when the action rule is activated. If conditions are given, the action is only denied if all of them are fulfilled.
+func (pr *PrincipalRule) DenyActionWithOutput(action, outputExpr string, m ...match) *PrincipalRule {
+	return pr.addActionWithOutput(action, effectv1.Effect_EFFECT_DENY, outputExpr, m)
+}
+
+func (pr *PrincipalRule) addActionWithOutput(action string, effect effectv1.Effect, outputExpr string, m []match) *PrincipalRule {
+	var cond *policyv1.Condition
+	switch len(m) {
+	case 0:
+	case 1:
+		cond = &policyv1.Condition{Condition: &policyv1.Condition_Match{Match: m[0].build()}}
+	default:
+		cond = &policyv1.Condition{Condition: &policyv1.Condition_Match{Match: MatchAllOf(m...).build()}}
+	}
+
+	pr.addAction(action, effect, cond)
+	if outputExpr == "" {
+		pr.err = multierr.Append(pr.err, fmt.Errorf("output expression for action '%s' must not be empty", action))
+		return pr
+	}
+
+	pr.rule.Actions[len(pr.rule.Actions)-1].Output = &policyv1.Output{Expr: outputExpr}
+	return pr
+}
+
 func (pr *PrincipalRule) addAction(action string, effect effectv1.Effect, comp *policyv1.Condition) *PrincipalRule {
 	pr.rule.Actions = append(pr.rule.Actions, &policyv1.PrincipalRule_Action{
 		Action:    action,
@@ -1157,17 +3433,22 @@ func (pr *PrincipalRule) addAction(action string, effect effectv1.Effect, comp *
 
 // Err returns errors accumulated during the construction of the rule.
 func (pr *PrincipalRule) Err() error {
-	return nil
+	return pr.err
 }
 
 // Validate checks whether the rule is valid.
 func (pr *PrincipalRule) Validate() error {
+	if pr.err != nil {
+		return pr.err
+	}
+
 	return pr.rule.Validate()
 }
 
 // DerivedRoles is a builder for derived roles.
 type DerivedRoles struct {
-	dr *policyv1.DerivedRoles
+	dr       *policyv1.DerivedRoles
+	disabled bool
 }
 
 // NewDerivedRoles creates a new derived roles set with the given name.
@@ -1180,6 +3461,12 @@ func NewDerivedRoles(name string) *DerivedRoles {
 	}
 }
 
+// WithDisabled sets whether the derived roles are disabled. Disabled policies are not used for evaluating requests.
+func (dr *DerivedRoles) WithDisabled(disabled bool) *DerivedRoles {
+	dr.disabled = disabled
+	return dr
+}
+
 // AddRole adds a new derived role with the given name which is an alias for the set of parent roles.
 func (dr *DerivedRoles) AddRole(name string, parentRoles []string) *DerivedRoles {
 	return dr.addRoleDef(name, parentRoles, nil)
@@ -1222,17 +3509,31 @@ func (dr *DerivedRoles) Validate() error {
 func (dr *DerivedRoles) build() (*policyv1.Policy, error) {
 	p := &policyv1.Policy{
 		ApiVersion: apiVersion,
+		Disabled:   dr.disabled,
 		PolicyType: &policyv1.Policy_DerivedRoles{
 			DerivedRoles: dr.dr,
 		},
 	}
 
+	// The schema requires parent roles regardless of conditions, but the generic validation error doesn't say which role is invalid.
+	var err error
+	for _, def := range dr.dr.Definitions {
+		if len(def.ParentRoles) == 0 {
+			err = multierr.Append(err, fmt.Errorf("derived role '%s' does not have any parent roles", def.Name))
+		}
+	}
+
+	if err != nil {
+		return p, err
+	}
+
 	return p, policy.Validate(p)
 }
 
 // ExportVariables is a builder for exported variables.
 type ExportVariables struct {
-	ev *policyv1.ExportVariables
+	ev       *policyv1.ExportVariables
+	disabled bool
 }
 
 // NewExportVariables creates a new exported variables set with the given name.
@@ -1245,6 +3546,12 @@ func NewExportVariables(name string) *ExportVariables {
 	}
 }
 
+// WithDisabled sets whether the exported variables are disabled. Disabled policies are not used for evaluating requests.
+func (ev *ExportVariables) WithDisabled(disabled bool) *ExportVariables {
+	ev.disabled = disabled
+	return ev
+}
+
 // AddVariable defines an exported variable with the given name to be computed by the given expression.
 func (ev *ExportVariables) AddVariable(name, expr string) *ExportVariables {
 	ev.ev.Definitions[name] = expr
@@ -1265,6 +3572,7 @@ func (ev *ExportVariables) Validate() error {
 func (ev *ExportVariables) build() (*policyv1.Policy, error) {
 	p := &policyv1.Policy{
 		ApiVersion: apiVersion,
+		Disabled:   ev.disabled,
 		PolicyType: &policyv1.Policy_ExportVariables{
 			ExportVariables: ev.ev,
 		},
@@ -1310,6 +3618,8 @@ func MatchNoneOf(m ...match) match {
 
 type match interface {
 	build() *policyv1.Match
+	// Proto returns the protobuf representation of the match.
+	Proto() *policyv1.Match
 }
 
 type matchExpr string
@@ -1319,6 +3629,10 @@ func (me matchExpr) build() *policyv1.Match {
 	return &policyv1.Match{Op: &policyv1.Match_Expr{Expr: expr}}
 }
 
+func (me matchExpr) Proto() *policyv1.Match {
+	return me.build()
+}
+
 type matchList struct {
 	cons func([]*policyv1.Match) *policyv1.Match
 	list []match
@@ -1333,6 +3647,10 @@ func (ml matchList) build() *policyv1.Match {
 	return ml.cons(exprList)
 }
 
+func (ml matchList) Proto() *policyv1.Match {
+	return ml.build()
+}
+
 type ServerInfo struct {
 	*responsev1.ServerInfoResponse
 }
@@ -1375,10 +3693,219 @@ func (e *AuditLogEntry) DecisionLog() (*auditv1.DecisionLogEntry, error) {
 	return e.decisionLog, e.err
 }
 
+// AuxData is a container for auxiliary data, such as JWTs, that policy conditions can access via `request.aux_data`.
+type AuxData struct {
+	a   *requestv1.AuxData
+	err error
+}
+
+// NewAuxData creates a new auxiliary data object.
+func NewAuxData() *AuxData {
+	return &AuxData{a: &requestv1.AuxData{}}
+}
+
+// WithJWT sets the JWT to be verified and decoded by the server.
+func (a *AuxData) WithJWT(token string) *AuxData {
+	if token == "" {
+		a.err = multierr.Append(a.err, errors.New("JWT must not be empty"))
+	}
+
+	a.jwt().Token = token
+	return a
+}
+
+// WithKeySetID sets the ID of the key set to use to verify the JWT.
+// It is only required if the server is configured with more than one key set.
+func (a *AuxData) WithKeySetID(id string) *AuxData {
+	a.jwt().KeySetId = id
+	return a
+}
+
+func (a *AuxData) jwt() *requestv1.AuxData_JWT {
+	if a.a.Jwt == nil {
+		a.a.Jwt = &requestv1.AuxData_JWT{}
+	}
+
+	return a.a.Jwt
+}
+
+// Proto returns the underlying protobuf object representing the auxiliary data.
+func (a *AuxData) Proto() *requestv1.AuxData {
+	return a.a
+}
+
+// Err returns any errors accumulated during the construction of the auxiliary data.
+func (a *AuxData) Err() error {
+	return a.err
+}
+
+// Validate checks whether the auxiliary data is valid.
+func (a *AuxData) Validate() error {
+	if a.err != nil {
+		return a.err
+	}
+
+	return a.a.Validate()
+}
+
 type PlanResourcesResponse struct {
 	*responsev1.PlanResourcesResponse
 }
 
+// PlanResourcesRequestBuilder is a builder for PlanResources API requests.
+type PlanResourcesRequestBuilder struct {
+	err       error
+	principal *Principal
+	resource  *enginev1.PlanResourcesInput_Resource
+	auxData   *requestv1.AuxData
+	actions   []string
+	actionSet []string
+}
+
+// NewPlanResourcesRequest creates a new PlanResources request builder for the given principal.
+func NewPlanResourcesRequest(principal *Principal) *PlanResourcesRequestBuilder {
+	return &PlanResourcesRequestBuilder{
+		principal: principal,
+		resource:  &enginev1.PlanResourcesInput_Resource{},
+	}
+}
+
+// WithResource sets the kind and the known attributes of the resources to plan for.
+func (b *PlanResourcesRequestBuilder) WithResource(kind string, attrs map[string]any) *PlanResourcesRequestBuilder {
+	b.resource.Kind = kind
+	b.resource.Attr = make(map[string]*structpb.Value, len(attrs))
+	for k, v := range attrs {
+		pbVal, err := util.ToStructPB(v)
+		if err != nil {
+			b.err = multierr.Append(b.err, fmt.Errorf("invalid attribute value for '%s': %w", k, err))
+			continue
+		}
+		b.resource.Attr[k] = pbVal
+	}
+
+	return b
+}
+
+// WithPolicyVersion sets the policy version of the resources to plan for.
+func (b *PlanResourcesRequestBuilder) WithPolicyVersion(policyVersion string) *PlanResourcesRequestBuilder {
+	b.resource.PolicyVersion = policyVersion
+	return b
+}
+
+// WithScope sets the scope of the resources to plan for.
+func (b *PlanResourcesRequestBuilder) WithScope(scope string) *PlanResourcesRequestBuilder {
+	b.resource.Scope = scope
+	return b
+}
+
+// WithAction sets the action to plan for.
+func (b *PlanResourcesRequestBuilder) WithAction(action string) *PlanResourcesRequestBuilder {
+	b.actions = append(b.actions, action)
+	return b
+}
+
+// WithActions sets the set of actions to plan for. It cannot be combined with WithAction.
+// The PlanResources API of this version only has a singular action field, so Build returns an error
+// if more than one action is provided.
+func (b *PlanResourcesRequestBuilder) WithActions(actions ...string) *PlanResourcesRequestBuilder {
+	b.actionSet = append(b.actionSet, actions...)
+	return b
+}
+
+// WithAuxData sets the auxiliary data for the request.
+// Any errors accumulated during the construction of the auxiliary data are reported by Err.
+func (b *PlanResourcesRequestBuilder) WithAuxData(auxData *AuxData) *PlanResourcesRequestBuilder {
+	if auxData == nil {
+		b.auxData = nil
+		return b
+	}
+
+	if err := auxData.Err(); err != nil {
+		b.err = multierr.Append(b.err, fmt.Errorf("invalid auxiliary data: %w", err))
+	}
+
+	b.auxData = auxData.Proto()
+	return b
+}
+
+// Err returns any errors accumulated during the construction of the request.
+func (b *PlanResourcesRequestBuilder) Err() error {
+	return b.err
+}
+
+// Build validates the inputs and creates the request.
+func (b *PlanResourcesRequestBuilder) Build() (*requestv1.PlanResourcesRequest, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.principal == nil {
+		return nil, errors.New("principal is required")
+	}
+
+	if err := b.principal.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid principal: %w", err)
+	}
+
+	if len(b.actions) > 0 && len(b.actionSet) > 0 {
+		return nil, errors.New("WithAction and WithActions cannot be used together")
+	}
+
+	actions := b.actions
+	if len(b.actionSet) > 0 {
+		if len(b.actionSet) > 1 {
+			return nil, fmt.Errorf("planning for multiple actions is not supported by this version of the API, got %d actions", len(b.actionSet))
+		}
+		actions = b.actionSet
+	}
+
+	if len(actions) != 1 {
+		return nil, fmt.Errorf("exactly one action must be provided, got %d", len(actions))
+	}
+
+	reqID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate request ID: %w", err)
+	}
+
+	req := &requestv1.PlanResourcesRequest{
+		RequestId: reqID.String(),
+		Action:    actions[0],
+		Principal: b.principal.p,
+		Resource:  b.resource,
+		AuxData:   b.auxData,
+	}
+
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	return req, nil
+}
+
+// FilterCEL returns the query plan filter as a CEL expression.
+// Always allowed and always denied filters are rendered as `true` and `false` respectively.
+func (p *PlanResourcesResponse) FilterCEL() (string, error) {
+	filter := p.GetFilter()
+	if filter == nil {
+		return "", errors.New("response does not contain a filter")
+	}
+
+	switch filter.GetKind() {
+	case enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED:
+		return "true", nil
+	case enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED:
+		return "false", nil
+	case enginev1.PlanResourcesFilter_KIND_CONDITIONAL:
+		if filter.GetCondition() == nil {
+			return "", errors.New("conditional filter does not have a condition")
+		}
+		return filterToCEL(filter.GetCondition())
+	default:
+		return "", fmt.Errorf("unexpected filter kind %s", filter.GetKind())
+	}
+}
+
 type (
 	ListPoliciesOption func(*requestv1.ListPoliciesRequest)
 )
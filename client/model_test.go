@@ -7,12 +7,27 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
 	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	requestv1 "github.com/cerbos/cerbos/api/genpb/cerbos/request/v1"
+	responsev1 "github.com/cerbos/cerbos/api/genpb/cerbos/response/v1"
+	schemav1 "github.com/cerbos/cerbos/api/genpb/cerbos/schema/v1"
+	"github.com/cerbos/cerbos/internal/conditions"
+	"github.com/cerbos/cerbos/internal/namer"
+	"github.com/cerbos/cerbos/internal/policy"
 )
 
 const (
@@ -357,3 +372,2357 @@ func newSchema(t *testing.T) *Schema {
 	return NewSchema(ref).
 		AddIgnoredActions(actionApprove)
 }
+
+func TestPolicySetScopes(t *testing.T) {
+	ps := NewPolicySet().
+		AddDerivedRoles(newDerivedRoles(t)).
+		AddResourcePolicies(
+			NewResourcePolicy(resource, version),
+			NewResourcePolicy(resource, version).WithScope(scope),
+		).
+		AddPrincipalPolicies(NewPrincipalPolicy(principal, version).WithScope(scope))
+	require.NoError(t, ps.Err())
+	require.Equal(t, []string{"", scope}, ps.Scopes())
+}
+
+func TestPolicySetCoveredKinds(t *testing.T) {
+	ps := NewPolicySet().
+		AddResourcePolicies(
+			NewResourcePolicy(resource, version),
+			NewResourcePolicy(resource, version).WithScope(scope),
+			NewResourcePolicy("expense", version),
+		).
+		AddPrincipalPolicies(newPrincipalPolicy(t))
+	require.NoError(t, ps.Err())
+	require.Equal(t, []string{"expense", resource}, ps.CoveredKinds())
+	require.True(t, ps.HasPolicyForKind(resource))
+	require.False(t, ps.HasPolicyForKind("purchase_order"))
+}
+
+func TestResourcePolicyWithSchemas(t *testing.T) {
+	rp := NewResourcePolicy(resource, version).
+		WithPrincipalSchema(NewSchema(ref)).
+		WithResourceSchema(NewSchema(ref))
+	require.Equal(t, ref, rp.p.Schemas.GetPrincipalSchema().GetRef())
+	require.Equal(t, ref, rp.p.Schemas.GetResourceSchema().GetRef())
+
+	rp = NewResourcePolicy(resource, version).WithResourceSchema(NewSchema(ref))
+	require.Nil(t, rp.p.Schemas.GetPrincipalSchema())
+	require.Equal(t, ref, rp.p.Schemas.GetResourceSchema().GetRef())
+}
+
+func TestPoliciesReferencingSchema(t *testing.T) {
+	const otherRef = "cerbos:///other.json"
+
+	ps := NewPolicySet().
+		AddResourcePolicies(
+			NewResourcePolicy(resource, version).WithScope(scope).WithResourceSchema(NewSchema(ref).AddIgnoredActions(actionApprove)),
+			NewResourcePolicy(resource, version).WithPrincipalSchema(NewSchema(ref).AddIgnoredActions(actionApprove)),
+			NewResourcePolicy("expense", version).WithResourceSchema(NewSchema(otherRef).AddIgnoredActions(actionApprove)),
+		).
+		AddPrincipalPolicies(newPrincipalPolicy(t))
+	require.NoError(t, ps.Err())
+
+	require.Equal(t, []string{namer.ResourcePolicyFQN(resource, version, ""), namer.ResourcePolicyFQN(resource, version, scope)}, ps.PoliciesReferencingSchema(ref))
+	require.Equal(t, []string{namer.ResourcePolicyFQN("expense", version, "")}, ps.PoliciesReferencingSchema(otherRef))
+	require.Empty(t, ps.PoliciesReferencingSchema("cerbos:///missing.json"))
+}
+
+func TestStrictNumbers(t *testing.T) {
+	const (
+		bigInt   = int64(9007199254740993)
+		smallInt = 5
+	)
+
+	t.Run("WithInt64Attr", func(t *testing.T) {
+		r := NewResource(kind, id).WithInt64Attr("big", bigInt).WithInt64Attr("small", smallInt)
+		require.NoError(t, r.Validate())
+		require.Equal(t, "9007199254740993", r.r.Attr["big"].GetStringValue())
+		require.Equal(t, float64(smallInt), r.r.Attr["small"].GetNumberValue())
+	})
+
+	t.Run("WithStrictNumbers", func(t *testing.T) {
+		p := NewPrincipal(id, roles...).WithStrictNumbers().WithAttributes(map[string]any{"big": bigInt, "small": smallInt})
+		require.NoError(t, p.Validate())
+		require.Equal(t, "9007199254740993", p.p.Attr["big"].GetStringValue())
+		require.Equal(t, float64(smallInt), p.p.Attr["small"].GetNumberValue())
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		r := NewResource(kind, id).WithStrictNumbers().WithAttributes(map[string]any{
+			"ids":     []int64{bigInt, smallInt},
+			"account": map[string]any{"id": uint64(bigInt), "tags": []any{"a", bigInt}},
+		})
+		require.NoError(t, r.Validate())
+		require.Equal(t, map[string]any{
+			"ids":     []any{"9007199254740993", float64(smallInt)},
+			"account": map[string]any{"id": "9007199254740993", "tags": []any{"a", "9007199254740993"}},
+		}, attrMap(r.r.Attr))
+	})
+}
+
+func TestSetAttributesPB(t *testing.T) {
+	attr := map[string]*structpb.Value{attrKey: structpb.NewStringValue(attrValue)}
+
+	r := NewResource(kind, id).WithAttr(stringAttrKey, stringAttr).SetAttributesPB(attr)
+	require.NoError(t, r.Validate())
+	require.Len(t, r.r.Attr, 1)
+	require.Equal(t, attrValue, r.r.Attr[attrKey].GetStringValue())
+
+	p := NewPrincipal(id, roles...).SetAttributesPB(attr)
+	require.NoError(t, p.Validate())
+	require.Equal(t, attrValue, p.p.Attr[attrKey].GetStringValue())
+
+	attr[attrKey] = structpb.NewStringValue(stringAttr)
+	require.Equal(t, attrValue, r.r.Attr[attrKey].GetStringValue())
+	require.Equal(t, attrValue, p.p.Attr[attrKey].GetStringValue())
+}
+
+func TestFirstDenied(t *testing.T) {
+	const matchedPolicy = "resource.leave_request.vdefault"
+
+	rr := &ResourceResult{
+		CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+			Actions: map[string]effectv1.Effect{
+				actionApprove: effectv1.Effect_EFFECT_ALLOW,
+				actionCreate:  effectv1.Effect_EFFECT_DENY,
+				"delete":      effectv1.Effect_EFFECT_DENY,
+			},
+			Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+				Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+					actionCreate: {MatchedPolicy: matchedPolicy},
+				},
+			},
+			Outputs: []*enginev1.OutputEntry{
+				{Src: "resource.expense.vdefault#rule-001", Val: structpb.NewStringValue("wrong")},
+				{Src: matchedPolicy + "#" + ruleName, Val: structpb.NewStringValue("not the owner")},
+			},
+		},
+	}
+
+	action, reason, ok := rr.FirstDenied()
+	require.True(t, ok)
+	require.Equal(t, actionCreate, action)
+	require.Equal(t, "not the owner", reason)
+
+	t.Run("two_outputs_from_same_policy", func(t *testing.T) {
+		rr := &ResourceResult{
+			CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+				Actions: map[string]effectv1.Effect{actionCreate: effectv1.Effect_EFFECT_DENY},
+				Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+					Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+						actionCreate: {MatchedPolicy: matchedPolicy},
+					},
+				},
+				Outputs: []*enginev1.OutputEntry{
+					{Src: matchedPolicy + "#rule-001", Val: structpb.NewStringValue("allowed by rule-001")},
+					{Src: matchedPolicy + "#rule-002", Val: structpb.NewStringValue("not the owner")},
+				},
+			},
+		}
+
+		action, reason, ok := rr.FirstDenied()
+		require.True(t, ok)
+		require.Equal(t, actionCreate, action)
+		require.Empty(t, reason)
+	})
+
+	t.Run("policy_decided_other_actions", func(t *testing.T) {
+		rr := &ResourceResult{
+			CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+				Actions: map[string]effectv1.Effect{
+					actionApprove: effectv1.Effect_EFFECT_ALLOW,
+					actionCreate:  effectv1.Effect_EFFECT_DENY,
+				},
+				Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+					Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+						actionApprove: {MatchedPolicy: matchedPolicy},
+						actionCreate:  {MatchedPolicy: matchedPolicy},
+					},
+				},
+				Outputs: []*enginev1.OutputEntry{
+					{Src: matchedPolicy + "#rule-001", Val: structpb.NewStringValue("allowed by rule-001")},
+				},
+			},
+		}
+
+		_, reason, ok := rr.FirstDenied()
+		require.True(t, ok)
+		require.Empty(t, reason)
+	})
+
+	rr.Meta = nil
+	action, reason, ok = rr.FirstDenied()
+	require.True(t, ok)
+	require.Equal(t, actionCreate, action)
+	require.Empty(t, reason)
+
+	_, _, ok = (&ResourceResult{err: errors.New("not found")}).FirstDenied()
+	require.False(t, ok)
+}
+
+type testRow struct {
+	err  error
+	attr map[string]any
+	id   string
+}
+
+type testRowIterator struct {
+	rows []testRow
+	pos  int
+}
+
+func (it *testRowIterator) Next() bool {
+	it.pos++
+	return it.pos <= len(it.rows)
+}
+
+func (it *testRowIterator) Row() (string, map[string]any, error) {
+	r := it.rows[it.pos-1]
+	return r.id, r.attr, r.err
+}
+
+func (it *testRowIterator) Err() error {
+	return nil
+}
+
+func TestBuildBatchFromRows(t *testing.T) {
+	rows := &testRowIterator{rows: []testRow{
+		{id: "XX125", attr: map[string]any{attrKey: attrValue}},
+		{id: "XX126", attr: map[string]any{attrKey: attrValue}},
+		{err: errors.New("scan failed")},
+		{id: "XX127", attr: map[string]any{attrKey: make(chan int)}},
+	}}
+
+	rb, err := BuildBatchFromRows([]string{actionApprove, actionCreate}, kind, rows)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "row #3")
+	require.ErrorContains(t, err, "row #4")
+	require.Len(t, rb.batch, 2)
+	require.NoError(t, rb.Validate())
+	for _, entry := range rb.batch {
+		require.Equal(t, kind, entry.Resource.Kind)
+		require.Equal(t, []string{actionApprove, actionCreate}, entry.Actions)
+		require.Equal(t, attrValue, entry.Resource.Attr[attrKey].GetStringValue())
+	}
+}
+
+func TestCommonAllowedActions(t *testing.T) {
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				{
+					Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX125", Kind: kind},
+					Actions: map[string]effectv1.Effect{
+						actionApprove: effectv1.Effect_EFFECT_ALLOW,
+						actionCreate:  effectv1.Effect_EFFECT_ALLOW,
+						"delete":      effectv1.Effect_EFFECT_ALLOW,
+					},
+				},
+				{
+					Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX126", Kind: kind},
+					Actions: map[string]effectv1.Effect{
+						actionApprove: effectv1.Effect_EFFECT_ALLOW,
+						actionCreate:  effectv1.Effect_EFFECT_ALLOW,
+						"delete":      effectv1.Effect_EFFECT_DENY,
+					},
+				},
+			},
+		},
+	}
+
+	require.Equal(t, []string{actionApprove, actionCreate}, crr.CommonAllowedActions("XX125", "XX126"))
+	require.Equal(t, []string{actionApprove, actionCreate, "delete"}, crr.CommonAllowedActions("XX125"))
+	require.Empty(t, crr.CommonAllowedActions("XX125", "XX999"))
+	require.Empty(t, crr.CommonAllowedActions())
+}
+
+func TestValidateImportsAgainst(t *testing.T) {
+	rp := newResourcePolicy(t).WithVariablesImports("unknown_variables")
+
+	err := rp.ValidateImportsAgainst(map[string]bool{exportVariablesName: true})
+	require.Error(t, err)
+	require.ErrorContains(t, err, "unknown_variables")
+	require.NotContains(t, err.Error(), exportVariablesName)
+
+	require.NoError(t, rp.ValidateImportsAgainst(map[string]bool{exportVariablesName: true, "unknown_variables": true}))
+}
+
+func TestCanonicalAttrJSON(t *testing.T) {
+	r := NewResource(kind, id).WithAttributes(map[string]any{
+		"z": 1,
+		"a": map[string]any{"y": true, "b": []any{"x", map[string]any{"d": 1, "c": 2}}},
+	})
+	require.NoError(t, r.Validate())
+
+	want := `{"a":{"b":["x",{"c":2,"d":1}],"y":true},"z":1}`
+	for i := 0; i < 10; i++ {
+		have, err := CanonicalAttrJSON(r.r.Attr)
+		require.NoError(t, err)
+		require.Equal(t, want, string(have))
+	}
+}
+
+func TestReadPolicyRejectDeprecated(t *testing.T) {
+	const policyFmt = `---
+apiVersion: api.cerbos.dev/v1
+%s
+resourcePolicy:
+  resource: leave_request
+  version: default
+  rules:
+    - actions: ["view"]
+      effect: EFFECT_ALLOW
+      roles: ["user"]
+`
+
+	p, err := ReadPolicyRejectDeprecated(strings.NewReader(fmt.Sprintf(policyFmt, "")))
+	require.NoError(t, err)
+	require.Equal(t, "leave_request", p.GetResourcePolicy().Resource)
+
+	_, err = ReadPolicyRejectDeprecated(strings.NewReader(fmt.Sprintf(policyFmt, "variables:\n  foo: \"42\"\nmetadata:\n  storeIdentifer: foo")))
+	require.Error(t, err)
+	require.ErrorContains(t, err, "metadata.storeIdentifer, variables")
+}
+
+func TestReadPolicyVerified(t *testing.T) {
+	const policyFmt = `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  resource: leave_request
+  version: default
+  rules:
+    - actions: ["view"]
+      effect: EFFECT_ALLOW
+      roles: ["%s"]
+`
+
+	original, err := policy.ReadPolicy(strings.NewReader(fmt.Sprintf(policyFmt, "user")))
+	require.NoError(t, err)
+	hash := policy.GetHash(original)
+
+	p, err := ReadPolicyVerified(strings.NewReader(fmt.Sprintf(policyFmt, "user")), hash)
+	require.NoError(t, err)
+	require.Equal(t, "leave_request", p.GetResourcePolicy().Resource)
+
+	_, err = ReadPolicyVerified(strings.NewReader(fmt.Sprintf(policyFmt, "admin")), hash)
+	require.ErrorContains(t, err, "policy hash mismatch")
+
+	tampered := fmt.Sprintf(policyFmt, "admin") + fmt.Sprintf("metadata:\n  hash: %d\n", hash)
+	_, err = ReadPolicyVerified(strings.NewReader(tampered), hash)
+	require.ErrorContains(t, err, "policy hash mismatch")
+}
+
+func TestAllOrNothingResourcePolicies(t *testing.T) {
+	testCases := []struct {
+		rp     *ResourcePolicy
+		name   string
+		effect effectv1.Effect
+	}{
+		{name: "DenyAll", rp: NewDenyAllResourcePolicy(resource, version), effect: effectv1.Effect_EFFECT_DENY},
+		{name: "AllowAll", rp: NewAllowAllResourcePolicy(resource, version), effect: effectv1.Effect_EFFECT_ALLOW},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.rp.Validate())
+			require.Len(t, tc.rp.p.Rules, 1)
+			require.Equal(t, []string{"*"}, tc.rp.p.Rules[0].Actions)
+			require.Equal(t, []string{"*"}, tc.rp.p.Rules[0].Roles)
+			require.Equal(t, tc.effect, tc.rp.p.Rules[0].Effect)
+		})
+	}
+}
+
+func TestResourceRuleWithAutoOutput(t *testing.T) {
+	rr := NewDenyResourceRule(actionApprove).WithRoles(roles...).WithAutoOutput().WithName(ruleName)
+	require.NoError(t, rr.Validate())
+	require.Equal(t, `{"rule": "rule-001", "effect": "deny"}`, rr.rule.Output.Expr)
+
+	ast, iss := conditions.StdEnv.Compile(rr.rule.Output.Expr)
+	require.NoError(t, iss.Err())
+	require.NotNil(t, ast)
+
+	rp := newResourcePolicy(t).AddResourceRules(rr)
+	require.NoError(t, rp.Validate())
+}
+
+func TestResourceRuleWithOutput(t *testing.T) {
+	rr := NewAllowResourceRule(actionApprove).WithRoles(roles...).WithAutoOutput().WithOutput(`"approved by " + P.id`).WithName(ruleName)
+	require.NoError(t, rr.Validate())
+	require.Equal(t, `"approved by " + P.id`, rr.rule.Output.Expr)
+
+	rp := newResourcePolicy(t).AddResourceRules(rr)
+	require.NoError(t, rp.Validate())
+
+	empty := NewAllowResourceRule(actionApprove).WithRoles(roles...).WithOutput("")
+	require.Error(t, empty.Err())
+	require.Error(t, empty.Validate())
+	require.Error(t, newResourcePolicy(t).AddResourceRules(empty).Validate())
+}
+
+func TestPrincipalRuleWithOutput(t *testing.T) {
+	pr := NewPrincipalRule(resource).
+		AllowActionWithOutput(actionApprove, `"approved by " + P.id`).
+		DenyActionWithOutput(actionCreate, `"denied"`)
+	require.NoError(t, pr.Validate())
+	require.Len(t, pr.rule.Actions, 2)
+	require.Equal(t, effectv1.Effect_EFFECT_ALLOW, pr.rule.Actions[0].Effect)
+	require.Equal(t, `"approved by " + P.id`, pr.rule.Actions[0].Output.Expr)
+	require.Equal(t, effectv1.Effect_EFFECT_DENY, pr.rule.Actions[1].Effect)
+	require.Equal(t, `"denied"`, pr.rule.Actions[1].Output.Expr)
+
+	pp := NewPrincipalPolicy("donald_duck", version).AddPrincipalRules(pr)
+	require.NoError(t, pp.Validate())
+
+	conditional := NewPrincipalRule(resource).
+		AllowActionWithOutput(actionApprove, `"approved"`, MatchExpr(`R.attr.owner == P.id`)).
+		DenyActionWithOutput(actionCreate, `"denied"`, MatchExpr(`R.attr.geography == "GB"`), MatchExpr(`P.attr.managed`))
+	require.NoError(t, conditional.Validate())
+	require.Equal(t, `R.attr.owner == P.id`, conditional.rule.Actions[0].Condition.GetMatch().GetExpr())
+	require.Equal(t, `"approved"`, conditional.rule.Actions[0].Output.Expr)
+	require.Len(t, conditional.rule.Actions[1].Condition.GetMatch().GetAll().GetOf(), 2)
+	require.Equal(t, `"denied"`, conditional.rule.Actions[1].Output.Expr)
+
+	empty := NewPrincipalRule(resource).AllowActionWithOutput(actionApprove, "")
+	require.Error(t, empty.Validate())
+	require.Len(t, empty.rule.Actions, 1)
+	require.Nil(t, empty.rule.Actions[0].Output)
+	require.Error(t, NewPrincipalPolicy("donald_duck", version).AddPrincipalRules(empty).Validate())
+}
+
+func TestWithDisabled(t *testing.T) {
+	ps := NewPolicySet().
+		AddResourcePolicies(newResourcePolicy(t).WithDisabled(true)).
+		AddPrincipalPolicies(newPrincipalPolicy(t).WithDisabled(true)).
+		AddDerivedRoles(newDerivedRoles(t).WithDisabled(true)).
+		AddExportVariables(newExportVariables(t).WithDisabled(true).WithDisabled(false))
+	require.NoError(t, ps.Validate())
+
+	policies := ps.GetPolicies()
+	require.Len(t, policies, 4)
+	require.True(t, policies[0].Disabled)
+	require.True(t, policies[1].Disabled)
+	require.True(t, policies[2].Disabled)
+	require.False(t, policies[3].Disabled)
+}
+
+func TestValidateSchemaIgnoreActions(t *testing.T) {
+	rp := newResourcePolicy(t).
+		AddResourceRules(
+			NewAllowResourceRule(actionApprove).WithRoles(roles...),
+			NewAllowResourceRule("view:*").WithRoles(roles...),
+		).
+		WithPrincipalSchema(NewSchema(ref).AddIgnoredActions(actionApprove, "view:public")).
+		WithResourceSchema(NewSchema(ref).AddIgnoredActions("view:*", actionCreate))
+	require.NoError(t, rp.Validate())
+
+	err := rp.ValidateSchemaIgnoreActions()
+	require.Error(t, err)
+	require.Len(t, multierr.Errors(err), 1)
+	require.ErrorContains(t, err, "resource schema ignores action 'create'")
+
+	require.NoError(t, newResourcePolicy(t).ValidateSchemaIgnoreActions())
+
+	wildcard := newResourcePolicy(t).
+		AddResourceRules(NewAllowResourceRule("*").WithRoles(roles...)).
+		WithResourceSchema(NewSchema(ref).AddIgnoredActions("view:public"))
+	require.NoError(t, wildcard.ValidateSchemaIgnoreActions())
+}
+
+func TestFilterCEL(t *testing.T) {
+	variable := func(v string) *enginev1.PlanResourcesFilter_Expression_Operand {
+		return &enginev1.PlanResourcesFilter_Expression_Operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Variable{Variable: v}}
+	}
+	value := func(v any) *enginev1.PlanResourcesFilter_Expression_Operand {
+		pv, err := structpb.NewValue(v)
+		require.NoError(t, err)
+		return &enginev1.PlanResourcesFilter_Expression_Operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Value{Value: pv}}
+	}
+	expr := func(op string, operands ...*enginev1.PlanResourcesFilter_Expression_Operand) *enginev1.PlanResourcesFilter_Expression_Operand {
+		return &enginev1.PlanResourcesFilter_Expression_Operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Expression{
+			Expression: &enginev1.PlanResourcesFilter_Expression{Operator: op, Operands: operands},
+		}}
+	}
+	response := func(kind enginev1.PlanResourcesFilter_Kind, cond *enginev1.PlanResourcesFilter_Expression_Operand) *PlanResourcesResponse {
+		return &PlanResourcesResponse{PlanResourcesResponse: &responsev1.PlanResourcesResponse{
+			Filter: &enginev1.PlanResourcesFilter{Kind: kind, Condition: cond},
+		}}
+	}
+
+	testCases := []struct {
+		name    string
+		resp    *PlanResourcesResponse
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "always allowed",
+			resp: response(enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED, nil),
+			want: "true",
+		},
+		{
+			name: "always denied",
+			resp: response(enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED, nil),
+			want: "false",
+		},
+		{
+			name: "comparison",
+			resp: response(enginev1.PlanResourcesFilter_KIND_CONDITIONAL,
+				expr("eq", variable("request.resource.attr.owner"), value("alice"))),
+			want: `request.resource.attr.owner == "alice"`,
+		},
+		{
+			name: "nested logical operators",
+			resp: response(enginev1.PlanResourcesFilter_KIND_CONDITIONAL,
+				expr("or",
+					expr("and",
+						expr("ge", variable("request.resource.attr.amount"), value(10)),
+						expr("not", expr("in", variable("request.resource.attr.status"), expr("list", value("DRAFT"), value("DELETED"))))),
+					expr("lt", expr("add", variable("request.resource.attr.a"), value(1)), value(5)))),
+			want: `((request.resource.attr.amount >= 10) && !(request.resource.attr.status in ["DRAFT", "DELETED"])) || ((request.resource.attr.a + 1) < 5)`,
+		},
+		{
+			name: "field access and comprehension",
+			resp: response(enginev1.PlanResourcesFilter_KIND_CONDITIONAL,
+				expr("exists", variable("request.resource.attr.tags"),
+					expr("lambda", expr("ne", expr("get-field", variable("t"), variable("name")), value("x")), variable("t")))),
+			want: `request.resource.attr.tags.exists(t, t.name != "x")`,
+		},
+		{
+			name:    "missing filter",
+			resp:    &PlanResourcesResponse{PlanResourcesResponse: &responsev1.PlanResourcesResponse{}},
+			wantErr: true,
+		},
+		{
+			name:    "missing condition",
+			resp:    response(enginev1.PlanResourcesFilter_KIND_CONDITIONAL, nil),
+			wantErr: true,
+		},
+		{
+			name: "wrong number of operands",
+			resp: response(enginev1.PlanResourcesFilter_KIND_CONDITIONAL,
+				expr("eq", variable("request.resource.attr.owner"))),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := tc.resp.FilterCEL()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.want, have)
+		})
+	}
+}
+
+func TestKeepOnly(t *testing.T) {
+	t.Run("Principal", func(t *testing.T) {
+		p := NewPrincipal(id, roles...).WithAttributes(attributes)
+		kept := p.KeepOnly(boolAttrKey, stringAttrKey, "missing")
+
+		require.Len(t, kept.Proto().Attr, 2)
+		require.Equal(t, boolAttr, kept.Proto().Attr[boolAttrKey].GetBoolValue())
+		require.Equal(t, stringAttr, kept.Proto().Attr[stringAttrKey].GetStringValue())
+		require.Equal(t, roles, kept.Roles())
+		require.Len(t, p.Proto().Attr, len(attributes))
+	})
+
+	t.Run("Resource", func(t *testing.T) {
+		var calls int
+		r := NewResource(kind, id).
+			WithAttributes(attributes).
+			WithLazyAttr(attrKey, func() (any, error) { return attrValue, nil }).
+			WithLazyAttr("dropped", func() (any, error) {
+				calls++
+				return attrValue, nil
+			})
+		kept := r.KeepOnly(doubleAttrKey, attrKey)
+
+		require.Len(t, kept.Proto().Attr, 2)
+		require.Equal(t, doubleAttr, kept.Proto().Attr[doubleAttrKey].GetNumberValue())
+		require.Equal(t, attrValue, kept.Proto().Attr[attrKey].GetStringValue())
+		require.Zero(t, calls)
+		require.Len(t, r.Proto().Attr, len(attributes)+2)
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		rec := NewAttrTypeRecorder()
+
+		p := NewPrincipal(id, roles...).WithAttrTypeRecorder(rec).WithStrictNumbers().WithAttr("age", 42).KeepOnly("age")
+		require.True(t, p.strictNumbers)
+		require.EqualError(t, p.WithAttr("age", "42").Err(), "type of attribute 'age' changed from number to string")
+
+		r := NewResource(kind, id).WithAttrTypeRecorder(rec).WithStrictNumbers().KeepOnly(attrKey)
+		require.True(t, r.strictNumbers)
+		require.EqualError(t, r.WithAttr("age", true).Err(), "type of attribute 'age' changed from number to bool")
+	})
+}
+
+func TestByKind(t *testing.T) {
+	result := func(id, kind string) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+		}
+	}
+
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				result("XX125", kind),
+				result("A1", "album"),
+				result("XX126", kind),
+				result("A2", "album"),
+			},
+		},
+	}
+
+	groups := crr.ByKind()
+	require.Len(t, groups, 2)
+
+	ids := func(results []*ResourceResult) []string {
+		out := make([]string, len(results))
+		for i, r := range results {
+			out[i] = r.Resource.Id
+		}
+		return out
+	}
+	require.Equal(t, []string{"XX125", "XX126"}, ids(groups[kind]))
+	require.Equal(t, []string{"A1", "A2"}, ids(groups["album"]))
+}
+
+func TestResourceBatchWithDefaultScope(t *testing.T) {
+	unscoped := NewResource(kind, "XX125")
+	scoped := NewResource(kind, "XX126").WithScope("other")
+
+	rb := NewResourceBatch().
+		Add(unscoped, actionApprove).
+		WithDefaultScope(scope).
+		Add(scoped, actionApprove).
+		Add(NewResource(kind, "XX127"), actionCreate)
+	require.NoError(t, rb.Validate())
+
+	entries := rb.entries()
+	require.Len(t, entries, 3)
+	require.Equal(t, scope, entries[0].Resource.Scope)
+	require.Equal(t, "other", entries[1].Resource.Scope)
+	require.Equal(t, scope, entries[2].Resource.Scope)
+	require.Equal(t, []string{actionCreate}, entries[2].Actions)
+
+	batchEntries := rb.toResourceBatchEntry()
+	require.Equal(t, scope, batchEntries[0].Resource.Scope)
+	require.Equal(t, "other", batchEntries[1].Resource.Scope)
+
+	require.Empty(t, unscoped.Proto().Scope, "original resource should not be modified")
+}
+
+func TestActionsByRole(t *testing.T) {
+	rp := NewResourcePolicy(resource, version).
+		AddResourceRules(
+			NewAllowResourceRule(actionCreate, actionApprove).WithRoles("user").WithCondition(MatchExpr("R.attr.owner == P.id")),
+			NewAllowResourceRule("view").WithRoles("user", "manager").WithDerivedRoles(roleName),
+			NewDenyResourceRule("delete").WithRoles("user"),
+		)
+	require.NoError(t, rp.Err())
+
+	require.Equal(t, map[string][]string{
+		"user":    {actionApprove, actionCreate, "view"},
+		"manager": {"view"},
+		roleName:  {"view"},
+	}, rp.ActionsByRole())
+}
+
+func TestNilResponseWrappers(t *testing.T) {
+	crr := &CheckResourcesResponse{}
+
+	require.NotPanics(t, func() {
+		rr := crr.GetResource(id)
+		require.Error(t, rr.Err())
+		require.False(t, rr.IsAllowed(actionApprove))
+
+		require.NoError(t, crr.Errors())
+		require.Empty(t, crr.ByKind())
+		require.Empty(t, crr.CommonAllowedActions(id))
+		require.NotEmpty(t, crr.String())
+
+		_, err := crr.MarshalJSON()
+		require.NoError(t, err)
+	})
+
+	crr = &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{nil, {}},
+	}}
+
+	require.NotPanics(t, func() {
+		require.Error(t, crr.GetResource(id).Err())
+		require.NoError(t, crr.Errors())
+	})
+}
+
+func TestFindAll(t *testing.T) {
+	result := func(id, kind, scope string) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind, Scope: scope},
+		}
+	}
+
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				result(id, kind, ""),
+				result("A1", "album", scope),
+				result(id, "album", scope),
+				result(id, kind, scope),
+			},
+		},
+	}
+
+	type key struct{ id, kind, scope string }
+	keys := func(results []*ResourceResult) []key {
+		out := make([]key, len(results))
+		for i, r := range results {
+			out[i] = key{r.Resource.Id, r.Resource.Kind, r.Resource.Scope}
+		}
+		return out
+	}
+
+	require.Equal(t, []key{{id, kind, ""}, {id, "album", scope}, {id, kind, scope}}, keys(crr.FindAll(id)))
+	require.Equal(t, []key{{id, kind, ""}, {id, kind, scope}}, keys(crr.FindAll(id, MatchResourceKind(kind))))
+	require.Equal(t, []key{{"A1", "album", scope}, {id, "album", scope}}, keys(crr.FindAll("", MatchResourceKind("album"))))
+	require.Len(t, crr.FindAll(""), 4)
+	require.Empty(t, crr.FindAll("missing"))
+}
+
+func TestPrincipalFromClaims(t *testing.T) {
+	t.Run("list of roles", func(t *testing.T) {
+		p, err := PrincipalFromClaims(map[string]any{
+			"sub":   principal,
+			"roles": []any{"user", "manager"},
+			"email": "bugs@example.com",
+			"iat":   float64(1700000000),
+		}, "roles")
+		require.NoError(t, err)
+		require.NoError(t, p.Validate())
+
+		require.Equal(t, principal, p.ID())
+		require.Equal(t, []string{"user", "manager"}, p.Roles())
+		require.Len(t, p.Proto().Attr, 2)
+		require.Equal(t, "bugs@example.com", p.Proto().Attr["email"].GetStringValue())
+		require.Equal(t, float64(1700000000), p.Proto().Attr["iat"].GetNumberValue())
+	})
+
+	t.Run("single role", func(t *testing.T) {
+		p, err := PrincipalFromClaims(map[string]any{"sub": principal, "group": "user"}, "group")
+		require.NoError(t, err)
+		require.Equal(t, []string{"user"}, p.Roles())
+		require.Empty(t, p.Proto().Attr)
+	})
+
+	t.Run("reserved claims", func(t *testing.T) {
+		p, err := PrincipalFromClaims(map[string]any{
+			"sub":   principal,
+			"roles": "user",
+			"scope": "openid profile email",
+			"id":    "mallory",
+			"email": "bugs@example.com",
+		}, "roles")
+		require.NoError(t, err)
+		require.NoError(t, p.Validate())
+		require.Equal(t, principal, p.ID())
+		require.Equal(t, map[string]any{"email": "bugs@example.com"}, p.Attributes())
+	})
+
+	testCases := []struct {
+		claims map[string]any
+		name   string
+	}{
+		{name: "missing sub", claims: map[string]any{"roles": "user"}},
+		{name: "missing roles", claims: map[string]any{"sub": principal}},
+		{name: "invalid roles", claims: map[string]any{"sub": principal, "roles": 42}},
+		{name: "invalid role value", claims: map[string]any{"sub": principal, "roles": []any{"user", 42}}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := PrincipalFromClaims(tc.claims, "roles")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestAddRulesForRoles(t *testing.T) {
+	rp := NewResourcePolicy(resource, version).
+		AddRulesForRoles([]string{"admin", "editor"},
+			NewAllowResourceRule(actionCreate),
+			NewAllowResourceRule(actionApprove).WithRoles("editor", "manager"),
+			nil,
+		)
+	require.NoError(t, rp.Validate())
+	require.Len(t, rp.p.Rules, 2)
+	require.Equal(t, []string{"admin", "editor"}, rp.p.Rules[0].Roles)
+	require.Equal(t, []string{"editor", "manager", "admin"}, rp.p.Rules[1].Roles)
+}
+
+func TestRolesForAction(t *testing.T) {
+	rp := NewResourcePolicy(resource, version).
+		AddResourceRules(
+			NewAllowResourceRule("view:*").WithRoles("user", "auditor"),
+			NewAllowResourceRule("view:public", actionApprove).WithRoles("user").WithDerivedRoles(roleName),
+			NewAllowResourceRule("*").WithRoles("admin").WithCondition(MatchExpr("R.attr.owner == P.id")),
+			NewDenyResourceRule("view:public").WithRoles("blocked"),
+		)
+	require.NoError(t, rp.Err())
+
+	require.Equal(t, []string{"admin", "auditor", roleName, "user"}, rp.RolesForAction("view:public"))
+	require.Equal(t, []string{"admin", roleName, "user"}, rp.RolesForAction(actionApprove))
+	require.Equal(t, []string{"admin"}, rp.RolesForAction("delete"))
+}
+
+func TestResourceBatchMarshalBinary(t *testing.T) {
+	rb := NewResourceBatch().
+		WithDefaultScope(scope).
+		Add(NewResource(kind, "XX125").WithAttr(attrKey, attrValue), actionApprove, actionCreate).
+		Add(NewResource(kind, "XX126").WithPolicyVersion(version).WithScope("other"), actionApprove).
+		Add(NewResource(kind, ""), actionApprove)
+	require.Error(t, rb.Err())
+
+	data, err := rb.MarshalBinary()
+	require.NoError(t, err)
+
+	restored, err := UnmarshalResourceBatch(data)
+	require.NoError(t, err)
+	require.NoError(t, restored.Validate())
+	require.Len(t, restored.batch, 2)
+
+	require.Equal(t, "XX125", restored.batch[0].Resource.Id)
+	require.Equal(t, scope, restored.batch[0].Resource.Scope)
+	require.Equal(t, attrValue, restored.batch[0].Resource.Attr[attrKey].GetStringValue())
+	require.Equal(t, []string{actionApprove, actionCreate}, restored.batch[0].Actions)
+	require.Equal(t, "other", restored.batch[1].Resource.Scope)
+	require.Equal(t, version, restored.batch[1].Resource.PolicyVersion)
+
+	_, err = UnmarshalResourceBatch([]byte("not a batch"))
+	require.Error(t, err)
+}
+
+func TestPrincipalHasRoles(t *testing.T) {
+	p := NewPrincipal(id)
+	require.False(t, p.HasRoles())
+	require.Error(t, p.Validate(), "principal without roles should be invalid")
+
+	require.False(t, NewPrincipal(id, "").HasRoles())
+
+	p.WithRoles(roles...)
+	require.True(t, p.HasRoles())
+	require.NoError(t, p.Validate())
+}
+
+func TestMaskActions(t *testing.T) {
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				{
+					Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+					Actions: map[string]effectv1.Effect{
+						actionApprove: effectv1.Effect_EFFECT_ALLOW,
+						actionCreate:  effectv1.Effect_EFFECT_DENY,
+						"admin:purge": effectv1.Effect_EFFECT_ALLOW,
+					},
+					Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+						Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+							actionApprove: {MatchedPolicy: "resource.leave_request.vdefault"},
+							"admin:purge": {MatchedPolicy: "resource.leave_request.vdefault"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	masked := crr.MaskActions(actionApprove, actionCreate)
+	rr := masked.GetResource(id)
+	require.NoError(t, rr.Err())
+	require.Equal(t, map[string]effectv1.Effect{
+		actionApprove: effectv1.Effect_EFFECT_ALLOW,
+		actionCreate:  effectv1.Effect_EFFECT_DENY,
+	}, rr.Actions)
+	require.Len(t, rr.Meta.Actions, 1)
+	require.Contains(t, rr.Meta.Actions, actionApprove)
+
+	require.Len(t, crr.GetResource(id).Actions, 3, "original response should not be modified")
+	require.Empty(t, (&CheckResourcesResponse{}).MaskActions(actionApprove).GetResults())
+
+	var nilResp *CheckResourcesResponse
+	require.Empty(t, nilResp.MaskActions(actionApprove).GetResults())
+
+	t.Run("outputs", func(t *testing.T) {
+		const (
+			leavePolicy  = "resource.leave_request.vdefault"
+			adminPolicy  = "principal.admin.vdefault"
+			sharedPolicy = "resource.leave_request.vdefault/acme"
+		)
+
+		crr := &CheckResourcesResponse{
+			CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+				Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+					{
+						Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+						Actions: map[string]effectv1.Effect{
+							actionApprove: effectv1.Effect_EFFECT_ALLOW,
+							actionCreate:  effectv1.Effect_EFFECT_DENY,
+							"admin:purge": effectv1.Effect_EFFECT_ALLOW,
+							"admin:audit": effectv1.Effect_EFFECT_ALLOW,
+						},
+						Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+							Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+								actionApprove: {MatchedPolicy: leavePolicy},
+								actionCreate:  {MatchedPolicy: sharedPolicy},
+								"admin:purge": {MatchedPolicy: adminPolicy},
+								"admin:audit": {MatchedPolicy: sharedPolicy},
+							},
+						},
+						Outputs: []*enginev1.OutputEntry{
+							{Src: leavePolicy + "#approve", Val: structpb.NewStringValue("approved")},
+							{Src: adminPolicy + "#purge", Val: structpb.NewStringValue("purged")},
+							{Src: sharedPolicy + "#audit", Val: structpb.NewStringValue("audited")},
+						},
+					},
+				},
+			},
+		}
+
+		rr := crr.MaskActions(actionApprove, actionCreate).GetResource(id)
+		require.NoError(t, rr.Err())
+		require.Len(t, rr.Outputs, 1)
+		require.Equal(t, leavePolicy+"#approve", rr.Outputs[0].Src)
+		require.Len(t, crr.GetResource(id).Outputs, 3, "original response should not be modified")
+
+		crr.Results[0].Meta = nil
+		require.Empty(t, crr.MaskActions(actionApprove, actionCreate).GetResource(id).Outputs)
+	})
+}
+
+func TestPlanResourcesRequestBuilder(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		auxData := NewAuxData().WithJWT("token")
+		req, err := NewPlanResourcesRequest(newPrincipal(t)).
+			WithResource(kind, map[string]any{attrKey: attrValue}).
+			WithPolicyVersion(version).
+			WithScope(scope).
+			WithAction(actionApprove).
+			WithAuxData(auxData).
+			Build()
+		require.NoError(t, err)
+
+		require.NotEmpty(t, req.RequestId)
+		require.Equal(t, actionApprove, req.Action)
+		require.Equal(t, id, req.Principal.Id)
+		require.Equal(t, kind, req.Resource.Kind)
+		require.Equal(t, version, req.Resource.PolicyVersion)
+		require.Equal(t, scope, req.Resource.Scope)
+		require.Equal(t, attrValue, req.Resource.Attr[attrKey].GetStringValue())
+		require.Equal(t, "token", req.AuxData.GetJwt().GetToken())
+	})
+
+	t.Run("single action set", func(t *testing.T) {
+		req, err := NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithActions(actionCreate).Build()
+		require.NoError(t, err)
+		require.Equal(t, actionCreate, req.Action)
+	})
+
+	testCases := []struct {
+		builder *PlanResourcesRequestBuilder
+		name    string
+	}{
+		{name: "invalid principal", builder: NewPlanResourcesRequest(NewPrincipal(id)).WithResource(kind, nil).WithAction(actionApprove)},
+		{name: "no action", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil)},
+		{name: "multiple actions", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithAction(actionApprove).WithAction(actionCreate)},
+		{name: "no resource", builder: NewPlanResourcesRequest(newPrincipal(t)).WithAction(actionApprove)},
+		{name: "action and action set", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithAction(actionApprove).WithActions(actionCreate)},
+		{name: "multiple actions in set", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithActions(actionApprove, actionCreate)},
+		{name: "empty action set", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithActions()},
+		{name: "invalid attribute", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, map[string]any{attrKey: struct{}{}}).WithAction(actionApprove)},
+		{name: "invalid aux data", builder: NewPlanResourcesRequest(newPrincipal(t)).WithResource(kind, nil).WithAction(actionApprove).WithAuxData(NewAuxData().WithJWT(""))},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.builder.Build()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestFlatAttributes(t *testing.T) {
+	attrs := map[string]any{
+		"department": map[string]any{"team": "platform", "floor": 3},
+		"tags":       []any{"a", map[string]any{"b": true}},
+		"empty":      map[string]any{},
+		"none":       []any{},
+		"owner":      principal,
+	}
+	want := map[string]any{
+		"department.team":  "platform",
+		"department.floor": float64(3),
+		"tags.0":           "a",
+		"tags.1.b":         true,
+		"empty":            map[string]any{},
+		"none":             []any{},
+		"owner":            principal,
+	}
+
+	require.Equal(t, want, NewPrincipal(id, roles...).WithAttributes(attrs).FlatAttributes())
+	require.Equal(t, want, NewResource(kind, id).WithAttributes(attrs).FlatAttributes())
+	require.Empty(t, NewResource(kind, id).FlatAttributes())
+}
+
+func TestDerivedRolesWithoutParentRoles(t *testing.T) {
+	dr := NewDerivedRoles(derivedRolesName).
+		AddRole(roleName, roles).
+		AddRole("orphan", nil).
+		AddRoleWithCondition("conditional_orphan", []string{}, MatchExpr("R.attr.public == true"))
+
+	err := dr.Validate()
+	require.Error(t, err)
+	require.Len(t, multierr.Errors(err), 2)
+	require.ErrorContains(t, err, "derived role 'orphan' does not have any parent roles")
+	require.ErrorContains(t, err, "derived role 'conditional_orphan' does not have any parent roles")
+	require.NotContains(t, err.Error(), roleName)
+
+	require.Error(t, NewPolicySet().AddDerivedRoles(dr).Err())
+}
+
+func TestFilterByLabel(t *testing.T) {
+	ps := NewPolicySet().
+		AddResourcePolicies(
+			NewResourcePolicy(resource, version).WithLabel("team", "hr").WithLabel("tier", "1"),
+			NewResourcePolicy("expense", version).WithLabel("team", "finance"),
+			NewResourcePolicy("timesheet", version).WithLabel("team", "hr"),
+			NewResourcePolicy("album", version),
+		).
+		AddPrincipalPolicies(newPrincipalPolicy(t))
+	require.NoError(t, ps.Err())
+
+	hr := ps.FilterByLabel("team", "hr")
+	require.NoError(t, hr.Err())
+	require.Equal(t, []string{resource, "timesheet"}, hr.CoveredKinds())
+	require.Equal(t, "1", hr.GetPolicies()[0].Metadata.Annotations["tier"])
+
+	require.Equal(t, 1, ps.FilterByLabel("tier", "1").Size())
+	require.Equal(t, 0, ps.FilterByLabel("team", "ops").Size())
+	require.Equal(t, 5, ps.Size())
+}
+
+func TestAllowedResources(t *testing.T) {
+	result := func(id, kind string, effect effectv1.Effect) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+			Actions:  map[string]effectv1.Effect{actionApprove: effect},
+		}
+	}
+
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				result("XX127", kind, effectv1.Effect_EFFECT_ALLOW),
+				result("XX125", kind, effectv1.Effect_EFFECT_DENY),
+				result("A1", "album", effectv1.Effect_EFFECT_ALLOW),
+				result("A1", kind, effectv1.Effect_EFFECT_ALLOW),
+				result("XX126", kind, effectv1.Effect_EFFECT_ALLOW),
+			},
+		},
+	}
+
+	require.Equal(t, []string{"XX127", "album/A1", kind + "/A1", "XX126"}, crr.AllowedResources(actionApprove))
+	require.Empty(t, crr.AllowedResources(actionCreate))
+}
+
+func TestFilterAllowed(t *testing.T) {
+	result := func(id, kind, scope string, effect effectv1.Effect) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind, Scope: scope},
+			Actions:  map[string]effectv1.Effect{actionApprove: effect},
+		}
+	}
+
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				result("XX127", kind, scope, effectv1.Effect_EFFECT_ALLOW),
+				result("XX125", kind, scope, effectv1.Effect_EFFECT_DENY),
+				result("A1", "album", "", effectv1.Effect_EFFECT_ALLOW),
+				result("XX126", kind, "", effectv1.Effect_EFFECT_ALLOW),
+			},
+		},
+	}
+
+	require.Equal(t, []string{"XX127", "A1", "XX126"}, crr.FilterAllowed(actionApprove))
+	require.Equal(t, []string{"XX127", "XX126"}, crr.FilterAllowed(actionApprove, MatchResourceKind(kind)))
+	require.Equal(t, []string{"XX127"}, crr.FilterAllowed(actionApprove, MatchResourceKind(kind), MatchResourceScope(scope)))
+	require.Empty(t, crr.FilterAllowed(actionCreate))
+}
+
+func TestEffect(t *testing.T) {
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Actions: map[string]effectv1.Effect{
+			actionApprove: effectv1.Effect_EFFECT_ALLOW,
+			actionCreate:  effectv1.Effect_EFFECT_DENY,
+		},
+	}}
+
+	require.Equal(t, effectv1.Effect_EFFECT_ALLOW, rr.Effect(actionApprove))
+	require.Equal(t, effectv1.Effect_EFFECT_DENY, rr.Effect(actionCreate))
+	require.Equal(t, effectv1.Effect_EFFECT_UNSPECIFIED, rr.Effect("view"))
+	require.Equal(t, effectv1.Effect_EFFECT_UNSPECIFIED, (&ResourceResult{err: errors.New("not found")}).Effect(actionApprove))
+}
+
+func TestEffectiveDerivedRoles(t *testing.T) {
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{EffectiveDerivedRoles: []string{"owner", "direct_manager"}},
+	}}
+
+	roles := rr.EffectiveDerivedRoles()
+	require.Equal(t, []string{"owner", "direct_manager"}, roles)
+	roles[0] = "changed"
+	require.Equal(t, "owner", rr.Meta.EffectiveDerivedRoles[0])
+
+	noMeta := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{}}
+	require.Nil(t, noMeta.EffectiveDerivedRoles())
+	require.Nil(t, (&ResourceResult{err: errors.New("not found")}).EffectiveDerivedRoles())
+}
+
+func TestMatchedPolicy(t *testing.T) {
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Meta: &responsev1.CheckResourcesResponse_ResultEntry_Meta{
+			Actions: map[string]*responsev1.CheckResourcesResponse_ResultEntry_Meta_EffectMeta{
+				actionApprove: {MatchedPolicy: "resource.leave_request.v1/acme", MatchedScope: scope},
+			},
+		},
+	}}
+
+	require.Equal(t, "resource.leave_request.v1/acme", rr.MatchedPolicy(actionApprove))
+	require.Equal(t, scope, rr.MatchedScope(actionApprove))
+	require.Empty(t, rr.MatchedPolicy(actionCreate))
+	require.Empty(t, rr.MatchedScope(actionCreate))
+
+	noMeta := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{}}
+	require.Empty(t, noMeta.MatchedPolicy(actionApprove))
+	require.Empty(t, (&ResourceResult{err: errors.New("not found")}).MatchedScope(actionApprove))
+}
+
+func TestAllowedDeniedActions(t *testing.T) {
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Actions: map[string]effectv1.Effect{
+			"view":    effectv1.Effect_EFFECT_ALLOW,
+			"approve": effectv1.Effect_EFFECT_ALLOW,
+			"delete":  effectv1.Effect_EFFECT_DENY,
+			"archive": effectv1.Effect(99),
+		},
+	}}
+
+	require.Equal(t, []string{"approve", "view"}, rr.AllowedActions())
+	require.Equal(t, []string{"archive", "delete"}, rr.DeniedActions())
+
+	failed := &ResourceResult{err: errors.New("not found")}
+	require.Nil(t, failed.AllowedActions())
+	require.Nil(t, failed.DeniedActions())
+}
+
+func TestOutputInto(t *testing.T) {
+	type reason struct {
+		Code    string `json:"code"`
+		Retries int    `json:"retries"`
+	}
+
+	out, err := structpb.NewValue(map[string]any{"code": "E42", "retries": 3})
+	require.NoError(t, err)
+
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Outputs: []*enginev1.OutputEntry{
+			{Src: "resource.leave_request.v1#rule-001", Val: out},
+			{Src: "resource.leave_request.v1#rule-002", Val: structpb.NewStringValue("text")},
+		},
+	}}
+
+	var have reason
+	require.NoError(t, rr.OutputInto("resource.leave_request.v1#rule-001", &have))
+	require.Equal(t, reason{Code: "E42", Retries: 3}, have)
+
+	require.ErrorContains(t, rr.OutputInto("missing", &have), "does not exist")
+	require.ErrorContains(t, rr.OutputInto("resource.leave_request.v1#rule-002", &have), "failed to decode")
+	require.Error(t, (&ResourceResult{err: errors.New("not found")}).OutputInto("any", &have))
+}
+
+func TestOutputValues(t *testing.T) {
+	out, err := structpb.NewValue(map[string]any{"code": "E42"})
+	require.NoError(t, err)
+
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Outputs: []*enginev1.OutputEntry{
+			{Src: "resource.leave_request.v1#rule-001", Val: out},
+			{Src: "resource.leave_request.v1#rule-002", Val: structpb.NewStringValue("text")},
+		},
+	}}
+
+	require.Equal(t, map[string]any{
+		"resource.leave_request.v1#rule-001": map[string]any{"code": "E42"},
+		"resource.leave_request.v1#rule-002": "text",
+	}, rr.OutputValues())
+
+	empty := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{}}
+	require.Nil(t, empty.OutputValues())
+}
+
+func TestGenericOutput(t *testing.T) {
+	type reason struct {
+		Code string `json:"code"`
+	}
+
+	out, err := structpb.NewValue(map[string]any{"code": "E42"})
+	require.NoError(t, err)
+
+	rr := &ResourceResult{CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+		Outputs: []*enginev1.OutputEntry{
+			{Src: "resource.leave_request.v1#rule-001", Val: out},
+			{Src: "resource.leave_request.v1#rule-002", Val: structpb.NewStringValue("text")},
+		},
+	}}
+
+	have, err := Output[reason](rr, "resource.leave_request.v1#rule-001")
+	require.NoError(t, err)
+	require.Equal(t, reason{Code: "E42"}, have)
+
+	text, err := Output[string](rr, "resource.leave_request.v1#rule-002")
+	require.NoError(t, err)
+	require.Equal(t, "text", text)
+
+	have, err = Output[reason](rr, "missing")
+	require.Error(t, err)
+	require.Zero(t, have)
+}
+
+func TestAllResults(t *testing.T) {
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX125", Kind: kind}},
+				nil,
+				{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX126", Kind: kind}},
+				{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX127", Kind: kind}},
+			},
+		},
+	}
+
+	var ids []string
+	crr.AllResults()(func(rr *ResourceResult) bool {
+		require.NoError(t, rr.Err())
+		ids = append(ids, rr.Resource.Id)
+		return rr.Resource.Id != "XX126"
+	})
+	require.Equal(t, []string{"XX125", "XX126"}, ids)
+
+	crbr := &CheckResourceBatchResponse{
+		CheckResourceBatchResponse: &responsev1.CheckResourceBatchResponse{
+			Results: []*responsev1.CheckResourceBatchResponse_ActionEffectMap{
+				{ResourceId: "XX125", Actions: map[string]effectv1.Effect{actionApprove: effectv1.Effect_EFFECT_ALLOW}},
+				{ResourceId: "XX126", Actions: map[string]effectv1.Effect{actionApprove: effectv1.Effect_EFFECT_DENY}},
+			},
+		},
+	}
+
+	allowed := make(map[string]bool)
+	crbr.AllResults()(func(rr *ResourceResult) bool {
+		allowed[rr.Resource.Id] = rr.IsAllowed(actionApprove)
+		return true
+	})
+	require.Equal(t, map[string]bool{"XX125": true, "XX126": false}, allowed)
+}
+
+func TestMatchCombinators(t *testing.T) {
+	res := &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind, Scope: scope}
+
+	require.True(t, MatchAll()(res))
+	require.True(t, MatchAll(MatchResourceKind(kind), MatchResourceScope(scope))(res))
+	require.False(t, MatchAll(MatchResourceKind(kind), MatchResourceScope("other"))(res))
+
+	require.False(t, MatchAny()(res))
+	require.True(t, MatchAny(MatchResourceKind("album"), MatchResourceKind(kind))(res))
+	require.False(t, MatchAny(MatchResourceKind("album"), MatchResourceKind("photo"))(res))
+
+	require.True(t, MatchNot(MatchResourceKind("album"))(res))
+	require.False(t, MatchNot(MatchAll())(res))
+}
+
+func TestMatchResourceID(t *testing.T) {
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX125", Kind: kind}},
+				{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX126", Kind: kind}},
+			},
+		},
+	}
+
+	res := &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind}
+	require.True(t, MatchResourceID(id)(res))
+	require.False(t, MatchResourceID("XX126")(res))
+
+	results := crr.FindAll("", MatchAny(MatchResourceID("XX126"), MatchResourceID("XX999")))
+	require.Len(t, results, 1)
+	require.Equal(t, "XX126", results[0].Resource.Id)
+}
+
+func TestMergeCheckResourcesResponses(t *testing.T) {
+	result := func(id string, effect effectv1.Effect) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+			Actions:  map[string]effectv1.Effect{actionApprove: effect},
+		}
+	}
+
+	first := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{result("XX125", effectv1.Effect_EFFECT_ALLOW)},
+	}}
+	// build the index of the first response to make sure the merged response doesn't reuse it
+	require.True(t, first.GetResource("XX125").IsAllowed(actionApprove))
+
+	second := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		RequestId: "req-2",
+		Results:   []*responsev1.CheckResourcesResponse_ResultEntry{result("XX126", effectv1.Effect_EFFECT_DENY)},
+	}}
+	third := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		RequestId: "req-3",
+		Results:   []*responsev1.CheckResourcesResponse_ResultEntry{result("XX127", effectv1.Effect_EFFECT_ALLOW)},
+	}}
+
+	merged := MergeCheckResourcesResponses(first, nil, second, third)
+	require.Equal(t, "req-2", merged.RequestId)
+	require.Len(t, merged.Results, 3)
+	require.True(t, merged.GetResource("XX125").IsAllowed(actionApprove))
+	require.False(t, merged.GetResource("XX126").IsAllowed(actionApprove))
+	require.True(t, merged.GetResource("XX127").IsAllowed(actionApprove))
+	require.Len(t, first.Results, 1)
+
+	require.Empty(t, MergeCheckResourcesResponses().Results)
+}
+
+func TestCheckResourceSetAllActions(t *testing.T) {
+	crsr := &CheckResourceSetResponse{CheckResourceSetResponse: &responsev1.CheckResourceSetResponse{
+		ResourceInstances: map[string]*responsev1.CheckResourceSetResponse_ActionEffectMap{
+			id: {Actions: map[string]effectv1.Effect{
+				actionApprove: effectv1.Effect_EFFECT_ALLOW,
+				actionCreate:  effectv1.Effect_EFFECT_DENY,
+			}},
+		},
+	}}
+
+	actions := crsr.AllActions(id)
+	require.Equal(t, map[string]effectv1.Effect{
+		actionApprove: effectv1.Effect_EFFECT_ALLOW,
+		actionCreate:  effectv1.Effect_EFFECT_DENY,
+	}, actions)
+
+	actions[actionCreate] = effectv1.Effect_EFFECT_ALLOW
+	require.False(t, crsr.IsAllowed(id, actionCreate))
+	require.Nil(t, crsr.AllActions("XX999"))
+}
+
+func TestResponseResourceIDs(t *testing.T) {
+	crr := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+			{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "XX127", Kind: kind}},
+			{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "A1", Kind: "album"}},
+			{Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: "A1", Kind: kind}},
+			nil,
+		},
+	}}
+	require.Equal(t, []string{"A1", "XX127"}, crr.ResourceIDs())
+
+	crbr := &CheckResourceBatchResponse{CheckResourceBatchResponse: &responsev1.CheckResourceBatchResponse{
+		Results: []*responsev1.CheckResourceBatchResponse_ActionEffectMap{
+			{ResourceId: "XX127"},
+			{ResourceId: "XX125"},
+			{ResourceId: "XX127"},
+		},
+	}}
+	require.Equal(t, []string{"XX125", "XX127"}, crbr.ResourceIDs())
+
+	crsr := &CheckResourceSetResponse{CheckResourceSetResponse: &responsev1.CheckResourceSetResponse{
+		ResourceInstances: map[string]*responsev1.CheckResourceSetResponse_ActionEffectMap{
+			"XX127": {},
+			"XX125": {},
+		},
+	}}
+	require.Equal(t, []string{"XX125", "XX127"}, crsr.ResourceIDs())
+
+	require.Empty(t, (&CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{}}).ResourceIDs())
+}
+
+func TestVersionMismatches(t *testing.T) {
+	result := func(id, kind, version string) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind, PolicyVersion: version},
+		}
+	}
+
+	crr := &CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+			Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+				result("XX125", kind, version),
+				result("XX126", kind, "default"),
+				result("A1", "album", "default"),
+				result("A1", kind, version),
+			},
+		},
+	}
+
+	require.Equal(t, []string{"XX126", "album/A1"}, crr.VersionMismatches(version))
+	require.Empty(t, (&CheckResourcesResponse{}).VersionMismatches(version))
+}
+
+func TestMergeAttributes(t *testing.T) {
+	newP := func() *Principal {
+		return NewPrincipal(id, roleName).WithAttributes(map[string]any{"teams": []any{"a", "b"}, "level": 1})
+	}
+
+	p := newP().MergeAttributes(map[string]any{"teams": []any{"b", "c"}, "level": 2, "region": "eu"}, LastWins)
+	require.NoError(t, p.Err())
+	require.Equal(t, map[string]any{"teams": []any{"b", "c"}, "level": float64(2), "region": "eu"}, attrMap(p.p.Attr))
+
+	p = newP().MergeAttributes(map[string]any{"teams": []any{"b", "c"}, "level": 2}, UnionLists)
+	require.NoError(t, p.Err())
+	require.Equal(t, map[string]any{"teams": []any{"a", "b", "c"}, "level": float64(2)}, attrMap(p.p.Attr))
+
+	p = newP().MergeAttributes(map[string]any{"level": 2}, func(string, *structpb.Value, *structpb.Value) *structpb.Value { return nil })
+	require.Equal(t, map[string]any{"teams": []any{"a", "b"}}, attrMap(p.p.Attr))
+}
+
+func attrMap(attr map[string]*structpb.Value) map[string]any {
+	m := make(map[string]any, len(attr))
+	for k, v := range attr {
+		m[k] = v.AsInterface()
+	}
+	return m
+}
+
+func TestMatchProto(t *testing.T) {
+	m := MatchAllOf(MatchExpr("a"), MatchNoneOf(MatchExpr("b")))
+	want := &policyv1.Match{Op: &policyv1.Match_All{All: &policyv1.Match_ExprList{Of: []*policyv1.Match{
+		{Op: &policyv1.Match_Expr{Expr: "a"}},
+		{Op: &policyv1.Match_None{None: &policyv1.Match_ExprList{Of: []*policyv1.Match{{Op: &policyv1.Match_Expr{Expr: "b"}}}}}},
+	}}}}
+
+	require.True(t, proto.Equal(want, m.Proto()))
+	require.True(t, proto.Equal(&policyv1.Match{Op: &policyv1.Match_Expr{Expr: "a"}}, MatchExpr("a").Proto()))
+}
+
+func TestWithAttributesFromProto(t *testing.T) {
+	msg := &policyv1.ResourceRule{
+		Actions:      []string{"view", "edit"},
+		DerivedRoles: []string{"owner"},
+		Effect:       effectv1.Effect_EFFECT_ALLOW,
+		Name:         ruleName,
+		Output:       &policyv1.Output{Expr: "R.id"},
+	}
+
+	r := NewResource(kind, id).WithAttributesFromProto(msg, "actions", "derivedRoles", "effect", "name", "output", "condition")
+	require.NoError(t, r.Err())
+	require.Equal(t, map[string]any{
+		"actions":       []any{"view", "edit"},
+		"derived_roles": []any{"owner"},
+		"effect":        "EFFECT_ALLOW",
+		"name":          ruleName,
+		"output":        map[string]any{"expr": "R.id"},
+		"condition":     nil,
+	}, attrMap(r.r.Attr))
+
+	r = NewResource(kind, id).WithAttributesFromProto(msg, "missing")
+	require.Error(t, r.Err())
+
+	r = NewResource(kind, id).WithAttributesFromProto(nil, "name")
+	require.ErrorContains(t, r.Err(), "message must not be nil")
+
+	r = NewResource(kind, id).WithAttributesFromProto((*policyv1.ResourceRule)(nil), "name")
+	require.ErrorContains(t, r.Err(), "message must not be nil")
+}
+
+func TestValidateAllParallel(t *testing.T) {
+	resourcePolicy := func(resource, cond string) *policyv1.Policy {
+		rule := &policyv1.ResourceRule{Actions: []string{actionApprove}, Roles: []string{roleName}, Effect: effectv1.Effect_EFFECT_ALLOW}
+		if cond != "" {
+			rule.Condition = &policyv1.Condition{Condition: &policyv1.Condition_Match{Match: &policyv1.Match{Op: &policyv1.Match_Expr{Expr: cond}}}}
+		}
+
+		return &policyv1.Policy{
+			ApiVersion: apiVersion,
+			PolicyType: &policyv1.Policy_ResourcePolicy{
+				ResourcePolicy: &policyv1.ResourcePolicy{Resource: resource, Version: version, Rules: []*policyv1.ResourceRule{rule}},
+			},
+		}
+	}
+
+	valid := NewPolicySet()
+	for i := 0; i < 20; i++ {
+		valid.AddPolicies(resourcePolicy(fmt.Sprintf("kind_%02d", i), "R.attr.public == true"))
+	}
+	require.NoError(t, valid.ValidateAllParallel(4))
+
+	invalid := NewPolicySet().AddPolicies(
+		resourcePolicy("zebra", "R.attr.public =="),
+		resourcePolicy("album", ""),
+		resourcePolicy("aardvark", "P.id +"),
+	)
+	for _, concurrency := range []int{0, 1, 3} {
+		errs := multierr.Errors(invalid.ValidateAllParallel(concurrency))
+		require.Len(t, errs, 2)
+		require.ErrorContains(t, errs[0], namer.ResourcePolicyFQN("aardvark", version, ""))
+		require.ErrorContains(t, errs[1], namer.ResourcePolicyFQN("zebra", version, ""))
+	}
+
+	require.Error(t, NewPolicySet().ValidateAllParallel(1))
+}
+
+type testMoney struct {
+	currency string
+	cents    int64
+}
+
+func TestRegisterAttrConverter(t *testing.T) {
+	RegisterAttrConverter(func(v any) (*structpb.Value, bool, error) {
+		m, ok := v.(testMoney)
+		if !ok {
+			return nil, false, nil
+		}
+
+		if m.currency == "" {
+			return nil, true, errors.New("missing currency")
+		}
+
+		return structpb.NewStringValue(fmt.Sprintf("%d %s", m.cents, m.currency)), true, nil
+	})
+
+	r := NewResource(kind, id).
+		WithAttr("price", testMoney{currency: "NZD", cents: 1250}).
+		WithAttributes(map[string]any{"owner": "alice"})
+	require.NoError(t, r.Err())
+	require.Equal(t, map[string]any{"price": "1250 NZD", "owner": "alice"}, attrMap(r.r.Attr))
+
+	p := NewPrincipal(id, roleName).WithAttributes(map[string]any{"budget": testMoney{cents: 10}})
+	require.ErrorContains(t, p.Err(), "missing currency")
+}
+
+func TestAttrTypeRecorder(t *testing.T) {
+	rec := NewAttrTypeRecorder()
+
+	r := NewResource(kind, id).WithAttrTypeRecorder(rec).WithAttr("age", 42).WithAttr("owner", nil)
+	require.NoError(t, r.Err())
+
+	r = NewResource(kind, id).WithAttrTypeRecorder(rec).WithAttributes(map[string]any{"age": 43, "owner": "alice"})
+	require.NoError(t, r.Err())
+
+	p := NewPrincipal(id, roleName).WithAttrTypeRecorder(rec).WithAttr("age", "43")
+	require.EqualError(t, p.Err(), "type of attribute 'age' changed from number to string")
+
+	require.NoError(t, (*AttrTypeRecorder)(nil).Check("age", structpb.NewStringValue("43")))
+
+	t.Run("WithInt64Attr", func(t *testing.T) {
+		rec := NewAttrTypeRecorder()
+
+		r := NewResource(kind, id).WithAttrTypeRecorder(rec).WithInt64Attr("account", 42).WithInt64Attr("account", 9007199254740993)
+		require.EqualError(t, r.Err(), "type of attribute 'account' changed from number to string")
+
+		p := NewPrincipal(id, roleName).WithAttrTypeRecorder(rec).WithInt64Attr("account", 9007199254740993)
+		require.EqualError(t, p.Err(), "type of attribute 'account' changed from number to string")
+	})
+
+	t.Run("MergeAttributes", func(t *testing.T) {
+		rec := NewAttrTypeRecorder()
+		keepIncoming := func(_ string, _, incoming *structpb.Value) *structpb.Value { return incoming }
+
+		p := NewPrincipal(id, roleName).WithAttrTypeRecorder(rec).
+			MergeAttributes(map[string]any{"age": 42}, keepIncoming).
+			MergeAttributes(map[string]any{"age": "42"}, keepIncoming)
+		require.EqualError(t, p.Err(), "type of attribute 'age' changed from number to string")
+	})
+}
+
+func TestAllExpressions(t *testing.T) {
+	ps := NewPolicySet().
+		AddResourcePolicies(NewResourcePolicy(resource, version).
+			WithVariable("is_owner", "R.attr.owner == P.id").
+			AddResourceRules(NewAllowResourceRule(actionApprove).
+				WithName(ruleName).
+				WithRoles(roleName).
+				WithCondition(MatchAllOf(MatchExpr("V.is_owner"), MatchExpr("R.attr.public"))))).
+		AddDerivedRoles(NewDerivedRoles(derivedRolesName).AddRoleWithCondition("owner", []string{roleName}, MatchExpr("R.attr.owner == P.id"))).
+		AddExportVariables(NewExportVariables(exportVariablesName).AddVariable(variableName, variableExpr))
+	require.NoError(t, ps.Err())
+
+	rpFQN := namer.ResourcePolicyFQN(resource, version, "")
+	require.Equal(t, []ExprLocation{
+		{FQN: rpFQN, RuleName: ruleName, Expr: "V.is_owner"},
+		{FQN: rpFQN, RuleName: ruleName, Expr: "R.attr.public"},
+		{FQN: rpFQN, RuleName: "is_owner", Expr: "R.attr.owner == P.id"},
+		{FQN: namer.DerivedRolesFQN(derivedRolesName), RuleName: "owner", Expr: "R.attr.owner == P.id"},
+		{FQN: namer.ExportVariablesFQN(exportVariablesName), RuleName: variableName, Expr: variableExpr},
+	}, ps.AllExpressions())
+}
+
+func TestWithParent(t *testing.T) {
+	folder := NewResource("folder", "F1").WithAttr("owner", "alice").WithAttr("id", "ignored")
+	doc := NewResource("document", "D1").WithAttr("public", false).WithParent(folder)
+	require.NoError(t, doc.Err())
+	require.Equal(t, map[string]any{
+		"public": false,
+		"parent": map[string]any{"kind": "folder", "id": "F1", "owner": "alice"},
+	}, attrMap(doc.r.Attr))
+
+	r := NewResource("folder", "F0")
+	for i := 1; i < MaxResourceParentDepth; i++ {
+		r = NewResource("folder", fmt.Sprintf("F%d", i)).WithParent(r)
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, MaxResourceParentDepth-1, resourceParentDepth(r.r.Attr))
+
+	last := NewResource("document", "D1").WithParent(r)
+	require.NoError(t, last.Err())
+
+	tooDeep := NewResource("document", "D2").WithParent(last)
+	require.Error(t, tooDeep.Err())
+
+	orphan := NewResource("document", "D3").WithParent(nil)
+	require.ErrorContains(t, orphan.Err(), "parent resource must not be nil")
+}
+
+func TestFingerprint(t *testing.T) {
+	result := func(id string, effect effectv1.Effect, outputs ...*enginev1.OutputEntry) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind, PolicyVersion: version},
+			Actions:  map[string]effectv1.Effect{actionApprove: effect, actionCreate: effectv1.Effect_EFFECT_DENY},
+			Outputs:  outputs,
+		}
+	}
+	output := func(src, val string) *enginev1.OutputEntry {
+		return &enginev1.OutputEntry{Src: src, Val: structpb.NewStringValue(val)}
+	}
+
+	a := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		RequestId: "req-1",
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+			result("XX125", effectv1.Effect_EFFECT_ALLOW, output("rule-1", "a"), output("rule-2", "b")),
+			result("XX126", effectv1.Effect_EFFECT_DENY),
+		},
+	}}
+
+	b := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		RequestId: "req-2",
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+			result("XX126", effectv1.Effect_EFFECT_DENY),
+			result("XX125", effectv1.Effect_EFFECT_ALLOW, output("rule-2", "b"), output("rule-1", "a")),
+		},
+	}}
+	b.Results[1].Meta = &responsev1.CheckResourcesResponse_ResultEntry_Meta{EffectiveDerivedRoles: []string{"owner"}}
+	require.Equal(t, a.Fingerprint(), b.Fingerprint())
+
+	b.Results[0].Actions[actionApprove] = effectv1.Effect_EFFECT_ALLOW
+	require.NotEqual(t, a.Fingerprint(), b.Fingerprint())
+
+	require.Equal(t, (&CheckResourcesResponse{}).Fingerprint(), (&CheckResourcesResponse{}).Fingerprint())
+}
+
+func TestReservedAttrKeys(t *testing.T) {
+	require.NoError(t, NewPrincipal(id, roleName).WithAttr("owner", "alice").Validate())
+	require.NoError(t, NewResource(kind, id).WithAttr("owner", "alice").Validate())
+
+	require.NoError(t, NewPrincipal(id, roleName).WithScope(scope).WithAttributes(map[string]any{"id": id, "roles": []any{roleName}, "scope": scope}).Validate())
+	require.NoError(t, NewResource(kind, id).WithAttributes(map[string]any{"id": id, "roles": []any{"admin"}}).Validate())
+
+	err := NewPrincipal(id, roleName).WithAttributes(map[string]any{"roles": []any{"admin"}, "scope": "acme"}).Validate()
+	require.Len(t, multierr.Errors(err), 2)
+	require.ErrorContains(t, err, "attribute 'roles' shadows the roles field with a different value")
+
+	require.EqualError(t, NewResource(kind, id).WithAttr("id", "XX126").Validate(), "attribute 'id' shadows the id field with a different value")
+	require.Contains(t, ReservedAttrKeys(), "kind")
+}
+
+func TestReadPolicyInterpolated(t *testing.T) {
+	const tmpl = `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  resource: leave_request
+  version: default
+  scope: "${ENV:CLUSTER_NAME}"
+  rules:
+    - actions: ["view"]
+      effect: EFFECT_ALLOW
+      roles: ["${ENV:VIEWER_ROLE}"]
+`
+
+	p, err := ReadPolicyInterpolated(strings.NewReader(tmpl), map[string]string{"CLUSTER_NAME": "acme", "VIEWER_ROLE": "user"})
+	require.NoError(t, err)
+	require.Equal(t, "acme", p.GetResourcePolicy().Scope)
+	require.Equal(t, []string{"user"}, p.GetResourcePolicy().Rules[0].Roles)
+
+	_, err = ReadPolicyInterpolated(strings.NewReader(tmpl), map[string]string{"CLUSTER_NAME": "acme"})
+	require.EqualError(t, err, "unresolved placeholders in policy: VIEWER_ROLE")
+
+	for _, hostile := range []string{
+		"acme\"\n  rules:\n    - actions: [\"*\"]\n      effect: EFFECT_ALLOW\n      roles: [\"*\"]\n#",
+		"user\", \"admin",
+		"acme\rx",
+	} {
+		_, err = ReadPolicyInterpolated(strings.NewReader(tmpl), map[string]string{"CLUSTER_NAME": hostile, "VIEWER_ROLE": "user"})
+		require.EqualError(t, err, "values of placeholders contain characters that are not allowed in policies: CLUSTER_NAME")
+	}
+}
+
+func TestFromProto(t *testing.T) {
+	t.Run("Principal", func(t *testing.T) {
+		pb := NewPrincipal(id, roleName).WithScope(scope).WithAttr(attrKey, attrValue).Proto()
+		p := NewPrincipalFromProto(pb).WithAttr("region", "eu").WithAttr("bad", func() {})
+		require.Error(t, p.Err())
+		require.Equal(t, scope, p.p.Scope)
+		require.Equal(t, map[string]any{attrKey: attrValue, "region": "eu"}, attrMap(p.p.Attr))
+		require.NotContains(t, pb.Attr, "region")
+
+		require.NoError(t, NewPrincipalFromProto(nil).WithAttr("region", "eu").Err())
+	})
+
+	t.Run("Resource", func(t *testing.T) {
+		pb := NewResource(kind, id).WithPolicyVersion(version).WithAttr(attrKey, attrValue).Proto()
+		r := NewResourceFromProto(pb).WithAttr("region", "eu")
+		require.NoError(t, r.Validate())
+		require.Equal(t, version, r.r.PolicyVersion)
+		require.Equal(t, map[string]any{attrKey: attrValue, "region": "eu"}, attrMap(r.r.Attr))
+		require.NotContains(t, pb.Attr, "region")
+
+		require.NoError(t, NewResourceFromProto(nil).WithAttr("region", "eu").Err())
+	})
+}
+
+func TestPartition(t *testing.T) {
+	result := func(id string, verrs ...*schemav1.ValidationError) *responsev1.CheckResourcesResponse_ResultEntry {
+		return &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource:         &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: id, Kind: kind},
+			Actions:          map[string]effectv1.Effect{actionApprove: effectv1.Effect_EFFECT_ALLOW},
+			ValidationErrors: verrs,
+		}
+	}
+
+	crr := &CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{
+		Results: []*responsev1.CheckResourcesResponse_ResultEntry{
+			result("XX125"),
+			result("XX126", &schemav1.ValidationError{Path: "/owner", Message: "required", Source: schemav1.ValidationError_SOURCE_RESOURCE}),
+			result("XX127"),
+		},
+	}}
+
+	valid, invalid := crr.Partition()
+	require.Len(t, valid, 2)
+	require.Equal(t, "XX125", valid[0].Resource.Id)
+	require.Equal(t, "XX127", valid[1].Resource.Id)
+	require.Len(t, invalid, 1)
+	require.Equal(t, "XX126", invalid[0].Resource.Id)
+	require.True(t, invalid[0].IsAllowed(actionApprove))
+
+	valid, invalid = (&CheckResourcesResponse{}).Partition()
+	require.Empty(t, valid)
+	require.Empty(t, invalid)
+}
+
+func TestDeleteAttr(t *testing.T) {
+	p := NewPrincipal(id, roleName).WithAttr("token", "secret").WithAttr(attrKey, attrValue).DeleteAttr("token").DeleteAttr("missing")
+	require.Equal(t, map[string]any{attrKey: attrValue}, attrMap(p.p.Attr))
+
+	p.DeleteAttr(attrKey)
+	require.NotNil(t, p.p.Attr)
+	require.Empty(t, p.p.Attr)
+	require.NoError(t, p.Validate())
+
+	require.Nil(t, NewPrincipal(id, roleName).DeleteAttr(attrKey).p.Attr)
+
+	r := NewResource(kind, id).
+		WithAttr(attrKey, attrValue).
+		WithLazyAttr("token", func() (any, error) { return "secret", nil }).
+		DeleteAttr("token").
+		DeleteAttr(attrKey)
+	require.NoError(t, r.Validate())
+	require.NotNil(t, r.r.Attr)
+	require.Empty(t, r.r.Attr)
+}
+
+func TestWithAttrsFromJSON(t *testing.T) {
+	data := []byte(`{"n": 9007199254740993, "f": 1.5, "geo": {"country": "NZ", "ids": [1, 2]}, "public": true, "owner": null}`)
+
+	p := NewPrincipal(id, roleName).WithAttr("dept", "eng").WithAttrsFromJSON(data)
+	require.NoError(t, p.Err())
+	require.Equal(t, map[string]any{
+		"dept":   "eng",
+		"n":      "9007199254740993",
+		"f":      1.5,
+		"geo":    map[string]any{"country": "NZ", "ids": []any{float64(1), float64(2)}},
+		"public": true,
+		"owner":  nil,
+	}, attrMap(p.Proto().Attr))
+
+	r := NewResource(kind, id).WithAttrsFromJSON(data)
+	require.NoError(t, r.Err())
+	require.Equal(t, "9007199254740993", r.Proto().Attr["n"].GetStringValue())
+
+	require.Error(t, NewPrincipal(id, roleName).WithAttrsFromJSON([]byte(`{"a":`)).Err())
+	require.Error(t, NewResource(kind, id).WithAttrsFromJSON([]byte(`[1, 2]`)).Err())
+	require.Error(t, NewResource(kind, id).WithAttrsFromJSON([]byte(`{} {}`)).Err())
+}
+
+func TestGetters(t *testing.T) {
+	p := NewPrincipal(id, roleName).
+		WithScope(scope).
+		WithPolicyVersion(version).
+		WithAttr("geo", map[string]any{"country": "NZ"})
+	require.Equal(t, scope, p.Scope())
+	require.Equal(t, version, p.PolicyVersion())
+
+	pAttr := p.Attributes()
+	require.Equal(t, map[string]any{"geo": map[string]any{"country": "NZ"}}, pAttr)
+	pAttr["geo"].(map[string]any)["country"] = "GB"
+	pAttr["new"] = true
+	require.Equal(t, map[string]any{"geo": map[string]any{"country": "NZ"}}, p.Attributes())
+
+	r := NewResource(kind, id).
+		WithScope(scope).
+		WithPolicyVersion(version).
+		WithLazyAttr("owner", func() (any, error) { return "alice", nil })
+	require.Equal(t, scope, r.Scope())
+	require.Equal(t, version, r.PolicyVersion())
+
+	rAttr := r.Attributes()
+	require.Equal(t, map[string]any{"owner": "alice"}, rAttr)
+	rAttr["owner"] = "bob"
+	require.Equal(t, map[string]any{"owner": "alice"}, r.Attributes())
+
+	require.Empty(t, NewPrincipal(id).Attributes())
+}
+
+func TestMergeFrom(t *testing.T) {
+	sso := NewPrincipal(id, roleName).WithAttributes(map[string]any{"dept": "eng", "email": "alice@example.com"})
+	db := NewPrincipal(id).WithAttributes(map[string]any{"dept": "sales", "teams": []any{"a"}})
+
+	p := NewPrincipal(id, roleName).MergeFrom(sso).MergeFrom(db).MergeFrom(nil)
+	require.NoError(t, p.Err())
+	// later sources win on collision
+	require.Equal(t, map[string]any{"dept": "sales", "email": "alice@example.com", "teams": []any{"a"}}, p.Attributes())
+
+	// values are copied rather than shared
+	p.Proto().Attr["teams"].GetListValue().Values[0] = structpb.NewStringValue("b")
+	require.Equal(t, []any{"a"}, db.Attributes()["teams"])
+
+	bad := NewPrincipal(id).WithAttr("ch", make(chan int))
+	require.Error(t, NewPrincipal(id, roleName).MergeFrom(bad).Err())
+}
+
+func TestWithAttributesFromStruct(t *testing.T) {
+	type Geo struct {
+		Country string `json:"country"`
+		Region  string `json:"region,omitempty"`
+	}
+
+	type Audit struct {
+		Owner string `json:"owner"`
+	}
+
+	type Doc struct {
+		Audit
+		Geo      *Geo              `json:"geo"`
+		Labels   map[string]string `json:"labels"`
+		Secret   string            `json:"-"`
+		Tags     []string          `json:"tags"`
+		Count    int               `json:"count"`
+		Public   bool
+		internal string
+	}
+
+	doc := Doc{
+		Audit:    Audit{Owner: "alice"},
+		Geo:      &Geo{Country: "NZ"},
+		Labels:   map[string]string{"env": "prod"},
+		Secret:   "s3cr3t",
+		Tags:     []string{"a", "b"},
+		Count:    3,
+		Public:   true,
+		internal: "x",
+	}
+
+	want := map[string]any{
+		"owner":  "alice",
+		"geo":    map[string]any{"country": "NZ"},
+		"labels": map[string]any{"env": "prod"},
+		"tags":   []any{"a", "b"},
+		"count":  float64(3),
+		"Public": true,
+	}
+
+	p := NewPrincipal(id, roleName).WithAttributesFromStruct(&doc)
+	require.NoError(t, p.Err())
+	require.Equal(t, want, p.Attributes())
+
+	r := NewResource(kind, id).WithAttributesFromStruct(doc)
+	require.NoError(t, r.Err())
+	require.Equal(t, want, r.Attributes())
+
+	t.Run("leaf_types", func(t *testing.T) {
+		type Event struct {
+			At      time.Time   `json:"at"`
+			History []time.Time `json:"history"`
+			ID      [4]byte     `json:"id"`
+		}
+
+		ts := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+		ev := Event{At: ts, History: []time.Time{ts}, ID: [4]byte{1, 2, 3, 4}}
+
+		// passed by value so that the array field is not addressable
+		r := NewResource(kind, id).WithAttributesFromStruct(ev)
+		require.NoError(t, r.Err())
+		require.Equal(t, map[string]any{
+			"at":      "2023-01-02T03:04:05Z",
+			"history": []any{"2023-01-02T03:04:05Z"},
+			"id":      "AQIDBA==",
+		}, r.Attributes())
+	})
+
+	type Bad struct {
+		Ch chan int
+	}
+
+	err := NewResource(kind, id).WithAttributesFromStruct(Bad{}).Err()
+	require.ErrorContains(t, err, "field 'Ch': unsupported type chan int")
+	require.Error(t, NewPrincipal(id, roleName).WithAttributesFromStruct("not a struct").Err())
+}
+
+func TestAuxData(t *testing.T) {
+	ad := NewAuxData().WithJWT("token").WithKeySetID("ks")
+	require.NoError(t, ad.Validate())
+	require.True(t, proto.Equal(&requestv1.AuxData{Jwt: &requestv1.AuxData_JWT{Token: "token", KeySetId: "ks"}}, ad.Proto()))
+
+	opts := &reqOpt{}
+	AuxDataFrom(ad)(opts)
+	require.Equal(t, ad.Proto(), opts.auxData)
+
+	require.NoError(t, NewAuxData().Validate())
+
+	empty := NewAuxData().WithJWT("")
+	require.Error(t, empty.Err())
+	require.Error(t, empty.Validate())
+
+	require.Error(t, NewAuxData().WithKeySetID("ks").Validate())
+}
+
+func TestNewPrincipalFromJWTClaims(t *testing.T) {
+	claims := map[string]any{
+		"sub":   "alice",
+		"id":    "mallory",
+		"roles": []any{"admin"},
+		"scope": "openid profile",
+		"email": "alice@example.com",
+		"org":   map[string]any{"id": "acme"},
+	}
+
+	p := NewPrincipalFromJWTClaims(id, claims, roleName)
+	require.NoError(t, p.Validate())
+	require.Equal(t, id, p.ID())
+	require.Equal(t, []string{roleName}, p.Roles())
+	require.Equal(t, map[string]any{
+		"sub":   "alice",
+		"email": "alice@example.com",
+		"org":   map[string]any{"id": "acme"},
+	}, p.Attributes())
+
+	bad := NewPrincipalFromJWTClaims(id, map[string]any{"ch": make(chan int), "ok": true}, roleName)
+	require.ErrorContains(t, bad.Err(), "invalid value for claim 'ch'")
+	require.Equal(t, map[string]any{"ok": true}, bad.Attributes())
+}
+
+func TestResourceSetAttrConversion(t *testing.T) {
+	ts := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		value any
+		name  string
+	}{
+		{name: "time", value: ts},
+		{name: "bytes", value: []byte("hello")},
+		{name: "typed_slice", value: []int{1, 2, 3}},
+		{name: "typed_map", value: map[string]string{"a": "b"}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewResource(kind, id).WithAttr(attrKey, tc.value)
+			require.NoError(t, r.Err())
+
+			rs := NewResourceSet(kind).AddResourceInstance(id, map[string]any{attrKey: tc.value})
+			require.NoError(t, rs.Err())
+			require.True(t, proto.Equal(r.Proto().Attr[attrKey], rs.rs.Instances[id].Attr[attrKey]))
+		})
+	}
+}
+
+func TestAddResourceInstanceWithErr(t *testing.T) {
+	rs, err := NewResourceSet(kind).AddResourceInstanceWithErr(id, map[string]any{attrKey: attrValue})
+	require.NoError(t, err)
+	require.Contains(t, rs.rs.Instances, id)
+
+	rs2, err := rs.AddResourceInstanceWithErr("XX999", map[string]any{"ch": make(chan int)})
+	require.Error(t, err)
+	require.Nil(t, rs2)
+	require.NotContains(t, rs.rs.Instances, "XX999")
+	require.NoError(t, rs.Err())
+}
+
+func TestRemoveResourceInstance(t *testing.T) {
+	rs := NewResourceSet(kind).RemoveResourceInstance(id)
+	require.Equal(t, 0, rs.Size())
+
+	rs.AddResourceInstance(id, map[string]any{attrKey: attrValue}).AddResourceInstance("XX999", nil)
+	require.Equal(t, 2, rs.Size())
+
+	rs.RemoveResourceInstance("XX999").RemoveResourceInstance("missing")
+	require.Equal(t, 1, rs.Size())
+	require.NoError(t, rs.Validate())
+
+	rs.RemoveResourceInstance(id)
+	require.Equal(t, 0, rs.Size())
+	require.Error(t, rs.Validate())
+}
+
+func TestResourceSetMerge(t *testing.T) {
+	a := NewResourceSet(kind).
+		AddResourceInstance(id, map[string]any{attrKey: "a"}).
+		AddResourceInstance("XX1", map[string]any{attrKey: "a"})
+	b := NewResourceSet(kind).
+		WithPolicyVersion(version).
+		AddResourceInstance(id, map[string]any{attrKey: "b"}).
+		AddResourceInstance("XX2", map[string]any{attrKey: "b"})
+
+	a.Merge(b).Merge(nil)
+	require.NoError(t, a.Validate())
+	require.Equal(t, 3, a.Size())
+	require.Equal(t, version, a.rs.PolicyVersion)
+	require.Equal(t, "b", a.rs.Instances[id].Attr[attrKey].GetStringValue())
+	require.Equal(t, "a", a.rs.Instances["XX1"].Attr[attrKey].GetStringValue())
+
+	t.Run("different_kind", func(t *testing.T) {
+		rs := NewResourceSet(kind).Merge(NewResourceSet("other").AddResourceInstance(id, nil))
+		require.Error(t, rs.Err())
+		require.Equal(t, 0, rs.Size())
+	})
+
+	t.Run("different_policy_version", func(t *testing.T) {
+		rs := NewResourceSet(kind).WithPolicyVersion(version).Merge(NewResourceSet(kind).WithPolicyVersion("v2"))
+		require.Error(t, rs.Err())
+		require.Equal(t, version, rs.rs.PolicyVersion)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		bad := NewResourceSet(kind).AddResourceInstance(id, map[string]any{"ch": make(chan int)})
+		require.Error(t, NewResourceSet(kind).Merge(bad).Err())
+	})
+}
+
+func TestResourceBatchEntries(t *testing.T) {
+	rb := NewResourceBatch()
+	require.Equal(t, 0, rb.Len())
+	require.Empty(t, rb.Entries())
+
+	rb.Add(NewResource(kind, id), actionApprove).
+		Add(NewResource(kind, "XX999").WithScope("other"), actionCreate).
+		WithDefaultScope(scope)
+	require.Equal(t, 2, rb.Len())
+
+	entries := rb.Entries()
+	require.Len(t, entries, 2)
+	require.Equal(t, scope, entries[0].Resource.Scope)
+	require.Equal(t, "other", entries[1].Resource.Scope)
+
+	entries[0] = nil
+	require.NotNil(t, rb.Entries()[0])
+}
+
+func TestResourceBatchMerge(t *testing.T) {
+	a := NewResourceBatch().AddResources([]string{actionApprove, actionCreate}, NewResource(kind, id), NewResource(kind, "XX1"))
+	require.NoError(t, a.Validate())
+	require.Equal(t, 2, a.Len())
+	require.Equal(t, []string{actionApprove, actionCreate}, a.Entries()[1].Actions)
+
+	b := NewResourceBatch().
+		WithDefaultScope(scope).
+		AddResources([]string{actionApprove}, NewResource(kind, "XX2"), NewResource("", "XX3"))
+	require.Error(t, b.Err())
+
+	a.Merge(b).Merge(nil)
+	require.Equal(t, 3, a.Len())
+	require.Equal(t, scope, a.Entries()[2].Resource.Scope)
+	require.Error(t, a.Err())
+}
+
+func TestResourceBatchAddWithErr(t *testing.T) {
+	rb, err := NewResourceBatch().AddWithErr(NewResource(kind, id), actionApprove)
+	require.NoError(t, err)
+	require.Equal(t, 1, rb.Len())
+
+	_, err = rb.AddWithErr(NewResource("", "XX1"), actionApprove)
+	require.ErrorContains(t, err, "invalid resource 'XX1'")
+
+	_, err = rb.AddWithErr(NewResource(kind, "XX2"))
+	require.Error(t, err)
+
+	_, err = rb.AddWithErr(nil, actionApprove)
+	require.Error(t, err)
+
+	lazy := NewResource(kind, "XX3").WithLazyAttr(attrKey, func() (any, error) { return nil, errors.New("boom") })
+	_, err = rb.AddWithErr(lazy, actionApprove)
+	require.Error(t, err)
+
+	require.Equal(t, 1, rb.Len())
+	require.NoError(t, rb.Err())
+}
+
+func TestResourceBatchChunk(t *testing.T) {
+	rb := NewResourceBatch().WithDefaultScope(scope)
+	for i := 0; i < 5; i++ {
+		rb.Add(NewResource(kind, fmt.Sprintf("XX%d", i)), actionApprove)
+	}
+
+	chunks := rb.Chunk(2)
+	require.Len(t, chunks, 3)
+	for i, c := range chunks {
+		require.NoError(t, c.Validate())
+		require.Equal(t, scope, c.Entries()[0].Resource.Scope)
+		require.Equal(t, fmt.Sprintf("XX%d", i*2), c.Entries()[0].Resource.Id)
+	}
+	require.Equal(t, 1, chunks[2].Len())
+
+	// appending to a chunk must not overwrite entries of the next chunk
+	chunks[0].Add(NewResource(kind, "new"), actionApprove)
+	require.Equal(t, "XX2", chunks[1].Entries()[0].Resource.Id)
+
+	require.Len(t, rb.Chunk(10), 1)
+	require.Equal(t, 5, rb.Chunk(10)[0].Len())
+	require.Len(t, NewResourceBatch().Chunk(10), 1)
+
+	invalid := rb.Chunk(0)
+	require.Len(t, invalid, 1)
+	require.Error(t, invalid[0].Err())
+
+	rb.Add(NewResource("", "bad"), actionApprove)
+	chunks = rb.Chunk(2)
+	require.Error(t, chunks[0].Err())
+	require.NoError(t, chunks[1].Err())
+}
+
+func TestBundle(t *testing.T) {
+	newPolicySet := func() *PolicySet {
+		return NewPolicySet().
+			AddResourcePolicies(NewResourcePolicy(resource, version).
+				WithDerivedRolesImports("common_roles").
+				WithVariablesImports("common_variables").
+				WithPrincipalSchema(NewSchema(ref).AddIgnoredActions(actionApprove)).
+				AddResourceRules(NewAllowResourceRule(actionApprove).WithRoles(roleName))).
+			AddDerivedRoles(NewDerivedRoles("common_roles").AddRole("owner", []string{roleName})).
+			AddExportVariables(NewExportVariables("common_variables").AddVariable("public", "R.attr.public"))
+	}
+
+	schemas := NewSchemaSet().AddSchemas(&schemav1.Schema{Id: "principal.json", Definition: []byte("{}")})
+
+	t.Run("valid", func(t *testing.T) {
+		require.NoError(t, NewBundle(newPolicySet(), schemas).Validate())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		ps := newPolicySet().
+			AddResourcePolicies(
+				NewResourcePolicy(resource, version).AddResourceRules(NewAllowResourceRule(actionApprove).WithRoles(roleName)),
+				NewResourcePolicy("expense", version).
+					WithDerivedRolesImports("missing_roles").
+					WithVariablesImports("missing_variables").
+					WithResourceSchema(NewSchema("cerbos:///expense.json").AddIgnoredActions(actionApprove)).
+					AddResourceRules(NewAllowResourceRule(actionApprove).WithRoles(roleName)),
+			)
+		require.NoError(t, ps.Err())
+
+		err := NewBundle(ps, schemas).Validate()
+		require.Error(t, err)
+		require.Len(t, multierr.Errors(err), 4)
+		require.ErrorContains(t, err, fmt.Sprintf("duplicate policy '%s'", namer.ResourcePolicyFQN(resource, version, "")))
+		require.ErrorContains(t, err, "references schema 'cerbos:///expense.json'")
+		require.ErrorContains(t, err, "imports derived roles 'missing_roles'")
+		require.ErrorContains(t, err, "imports variables 'missing_variables'")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.Error(t, NewBundle(nil, nil).Validate())
+	})
+}
+
+func TestWithNormalizedID(t *testing.T) {
+	p := NewPrincipal(" "+id+"\t", roleName).WithNormalizedID(TrimSpaceNormalizer)
+	require.Equal(t, id, p.ID())
+
+	r := NewResource(kind, strings.ToUpper(id)+" ").WithNormalizedID(TrimSpaceNormalizer).WithNormalizedID(strings.ToLower)
+	require.Equal(t, strings.ToLower(id), r.ID())
+}
+
+func TestRequireAttributes(t *testing.T) {
+	r := NewResource(kind, id).
+		WithAttr("owner", "alice").
+		WithAttr("department", nil).
+		WithLazyAttr("region", func() (any, error) { return "eu", nil })
+
+	require.NoError(t, r.RequireAttributes("owner", "region"))
+
+	err := r.RequireAttributes("owner", "department", "team")
+	require.EqualError(t, err, fmt.Sprintf("resource '%s' of kind '%s' is missing required attributes: department, team", id, kind))
+}
+
+func TestHasUnknownEffect(t *testing.T) {
+	rr := &ResourceResult{
+		CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+			Actions: map[string]effectv1.Effect{
+				actionApprove: effectv1.Effect_EFFECT_ALLOW,
+				actionCreate:  effectv1.Effect_EFFECT_DENY,
+			},
+		},
+	}
+	require.False(t, rr.HasUnknownEffect())
+
+	rr.Actions["delete"] = effectv1.Effect(42)
+	require.True(t, rr.HasUnknownEffect())
+	require.Equal(t, []string{"delete"}, rr.UnknownEffectActions())
+	require.False(t, rr.IsAllowed("delete"))
+}
+
+func TestEffects(t *testing.T) {
+	rr := &ResourceResult{
+		CheckResourcesResponse_ResultEntry: &responsev1.CheckResourcesResponse_ResultEntry{
+			Actions: map[string]effectv1.Effect{
+				actionApprove: effectv1.Effect_EFFECT_ALLOW,
+				actionCreate:  effectv1.Effect_EFFECT_DENY,
+			},
+		},
+	}
+
+	effects := rr.Effects()
+	require.Equal(t, map[string]effectv1.Effect{actionApprove: effectv1.Effect_EFFECT_ALLOW, actionCreate: effectv1.Effect_EFFECT_DENY}, effects)
+
+	effects[actionCreate] = effectv1.Effect_EFFECT_ALLOW
+	require.False(t, rr.IsAllowed(actionCreate))
+
+	require.Nil(t, (&CheckResourcesResponse{}).GetResource(id).Effects())
+}
+
+func TestPrincipalClone(t *testing.T) {
+	base := NewPrincipal(id, roleName).
+		WithPolicyVersion(version).
+		WithAttr("tags", []any{"a"}).
+		WithAttr("bad", func() {})
+	require.Error(t, base.Err())
+
+	c := base.Clone().WithAttr("session", "s1").WithRoles("admin")
+	require.NoError(t, c.Err())
+	require.Equal(t, version, c.p.PolicyVersion)
+	require.Equal(t, []string{roleName, "admin"}, c.Roles())
+
+	c.p.Attr["tags"].GetListValue().Values[0] = structpb.NewStringValue("b")
+	require.Equal(t, []any{"a"}, base.p.Attr["tags"].AsInterface())
+	require.NotContains(t, base.p.Attr, "session")
+	require.Equal(t, []string{roleName}, base.Roles())
+
+	clones := make([]*Principal, 8)
+	var wg sync.WaitGroup
+	for i := range clones {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clones[i] = base.Clone().WithAttr("request", i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, c := range clones {
+		require.Equal(t, float64(i), c.p.Attr["request"].GetNumberValue())
+	}
+	require.NotContains(t, base.p.Attr, "request")
+}
+
+func TestResourceClone(t *testing.T) {
+	tmpl := NewResource(kind, id).
+		WithScope(scope).
+		WithPolicyVersion(version).
+		WithAttr("geo", map[string]any{"country": "NZ"}).
+		WithAttr("bad", func() {})
+	require.Error(t, tmpl.Err())
+
+	c := tmpl.Clone().WithAttr("owner", "alice")
+	require.NoError(t, c.Err())
+	require.Equal(t, kind, c.Kind())
+	require.Equal(t, scope, c.r.Scope)
+	require.Equal(t, version, c.r.PolicyVersion)
+
+	c.r.Id = "XX126"
+	c.r.Attr["geo"].GetStructValue().Fields["country"] = structpb.NewStringValue("GB")
+	require.Equal(t, id, tmpl.ID())
+	require.Equal(t, map[string]any{"country": "NZ"}, tmpl.r.Attr["geo"].AsInterface())
+	require.NotContains(t, tmpl.r.Attr, "owner")
+
+	clones := make([]*Resource, 8)
+	var wg sync.WaitGroup
+	for i := range clones {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clones[i] = tmpl.Clone().WithAttr("instance", i)
+			clones[i].r.Id = fmt.Sprintf("R%d", i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, c := range clones {
+		require.Equal(t, fmt.Sprintf("R%d", i), c.ID())
+		require.Equal(t, float64(i), c.r.Attr["instance"].GetNumberValue())
+	}
+	require.NotContains(t, tmpl.r.Attr, "instance")
+	require.Equal(t, id, tmpl.ID())
+}
+
+func TestWithLazyAttr(t *testing.T) {
+	calls := 0
+	r := NewResource(kind, id).WithLazyAttr(attrKey, func() (any, error) {
+		calls++
+		return attrValue, nil
+	})
+	require.Equal(t, 0, calls)
+	require.Nil(t, r.r.Attr)
+
+	require.NoError(t, r.Validate())
+	require.Equal(t, attrValue, r.Proto().Attr[attrKey].GetStringValue())
+	require.Equal(t, 1, calls)
+
+	failing := NewResource(kind, id).WithLazyAttr(attrKey, func() (any, error) {
+		return nil, errors.New("boom")
+	})
+	require.Error(t, failing.Validate())
+
+	rb := NewResourceBatch().Add(NewResource(kind, id).WithLazyAttr(attrKey, func() (any, error) {
+		return nil, errors.New("boom")
+	}), actionApprove)
+	require.Error(t, rb.Err())
+}
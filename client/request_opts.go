@@ -29,6 +29,14 @@ func AuxDataJWT(token, keySetID string) RequestOpt {
 	}
 }
 
+// AuxDataFrom sets the auxiliary data to be sent with the request.
+// The auxiliary data should be validated beforehand because request options cannot report errors.
+func AuxDataFrom(auxData *AuxData) RequestOpt {
+	return func(opts *reqOpt) {
+		opts.auxData = auxData.Proto()
+	}
+}
+
 // IncludeMeta sets the flag on requests that support it to signal that evaluation metadata should be sent back with the response.
 func IncludeMeta(f bool) RequestOpt {
 	return func(opt *reqOpt) {
@@ -4,14 +4,33 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
 	schemav1 "github.com/cerbos/cerbos/api/genpb/cerbos/schema/v1"
+	"github.com/cerbos/cerbos/internal/util"
 )
 
 const MaxIDPerReq = 25
 
+// maxSafeInteger is the largest integer that can be represented exactly by a float64.
+const maxSafeInteger = 1<<53 - 1
+
 func BatchAdminClientCall(ctx context.Context, retrieveFn func(context.Context, ...string) (uint32, error), ids ...string) (uint32, error) {
 	var total uint32
 	for idx := range ids {
@@ -58,3 +77,589 @@ func MinInt(a, b int) int {
 	}
 	return b
 }
+
+// CanonicalAttrJSON returns a JSON representation of the given attributes that is stable across invocations.
+// Object keys are sorted at every level of nesting, which makes the output suitable for use in cache keys.
+func CanonicalAttrJSON(attr map[string]*structpb.Value) ([]byte, error) {
+	m := make(map[string]any, len(attr))
+	for k, v := range attr {
+		m[k] = v.AsInterface()
+	}
+
+	// encoding/json sorts map keys when marshaling, and structpb values only contain maps, slices and primitives.
+	return json.Marshal(m)
+}
+
+// AttrConverter converts a value to an attribute value.
+// It returns false if it does not handle values of the given type.
+type AttrConverter func(any) (*structpb.Value, bool, error)
+
+var (
+	attrConverters   []AttrConverter
+	attrConvertersMu sync.RWMutex
+)
+
+// RegisterAttrConverter registers a converter that is consulted, in registration order, before the default conversion
+// when attributes are added to principals and resources. Only top-level attribute values are passed to the converter.
+func RegisterAttrConverter(conv func(any) (*structpb.Value, bool, error)) {
+	attrConvertersMu.Lock()
+	defer attrConvertersMu.Unlock()
+
+	attrConverters = append(attrConverters, conv)
+}
+
+func customStructPB(v any) (*structpb.Value, bool, error) {
+	attrConvertersMu.RLock()
+	defer attrConvertersMu.RUnlock()
+
+	for _, conv := range attrConverters {
+		if pbVal, ok, err := conv(v); ok || err != nil {
+			return pbVal, ok, err
+		}
+	}
+
+	return nil, false, nil
+}
+
+func toStructPB(v any, strictNumbers bool) (*structpb.Value, error) {
+	pbVal, ok, err := customStructPB(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		return pbVal, nil
+	}
+
+	if strictNumbers {
+		return strictNumbersToStructPB(v)
+	}
+
+	return util.ToStructPB(v)
+}
+
+// strictNumbersToStructPB converts the value like util.ToStructPB, except that integers that can't be represented
+// exactly as a float64 are encoded as strings wherever they appear in nested maps and slices.
+func strictNumbersToStructPB(v any) (*structpb.Value, error) {
+	switch n := v.(type) {
+	case int:
+		return int64ToStructPB(int64(n)), nil
+	case int64:
+		return int64ToStructPB(n), nil
+	case uint:
+		return uint64ToStructPB(uint64(n)), nil
+	case uint64:
+		return uint64ToStructPB(n), nil
+	case []byte:
+		return util.ToStructPB(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			break
+		}
+
+		values := make([]*structpb.Value, rv.Len())
+		for i := range values {
+			pbVal, err := strictNumbersToStructPB(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			values[i] = pbVal
+		}
+
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	case reflect.Map:
+		if rv.IsNil() || rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+
+		fields := make(map[string]*structpb.Value, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			pbVal, err := strictNumbersToStructPB(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			fields[iter.Key().String()] = pbVal
+		}
+
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	}
+
+	return util.ToStructPB(v)
+}
+
+func int64ToStructPB(n int64) *structpb.Value {
+	if n > maxSafeInteger || n < -maxSafeInteger {
+		return structpb.NewStringValue(strconv.FormatInt(n, 10))
+	}
+
+	return structpb.NewNumberValue(float64(n))
+}
+
+func uint64ToStructPB(n uint64) *structpb.Value {
+	if n > maxSafeInteger {
+		return structpb.NewStringValue(strconv.FormatUint(n, 10))
+	}
+
+	return structpb.NewNumberValue(float64(n))
+}
+
+func cloneAttrPB(attr map[string]*structpb.Value) map[string]*structpb.Value {
+	if attr == nil {
+		return nil
+	}
+
+	c := make(map[string]*structpb.Value, len(attr))
+	for k, v := range attr {
+		c[k] = proto.Clone(v).(*structpb.Value)
+	}
+
+	return c
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// attrsFromPB converts attribute values to freshly allocated Go values.
+func attrsFromPB(attr map[string]*structpb.Value) map[string]any {
+	m := make(map[string]any, len(attr))
+	for k, v := range attr {
+		m[k] = v.AsInterface()
+	}
+
+	return m
+}
+
+func keepAttrPB(attr map[string]*structpb.Value, keys []string) map[string]*structpb.Value {
+	if attr == nil {
+		return nil
+	}
+
+	kept := make(map[string]*structpb.Value, len(keys))
+	for _, k := range keys {
+		if v, ok := attr[k]; ok {
+			kept[k] = v
+		}
+	}
+
+	return kept
+}
+
+// flattenAttrs converts nested attributes to a flat map with dotted keys. List elements are keyed by their index.
+// Empty structs and lists are kept as leaf values so that their keys are not lost.
+func flattenAttrs(attr map[string]*structpb.Value) map[string]any {
+	flat := make(map[string]any, len(attr))
+	for k, v := range attr {
+		flattenValue(flat, k, v)
+	}
+
+	return flat
+}
+
+func flattenValue(flat map[string]any, key string, v *structpb.Value) {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_StructValue:
+		if len(k.StructValue.GetFields()) == 0 {
+			flat[key] = map[string]any{}
+			return
+		}
+
+		for fk, fv := range k.StructValue.GetFields() {
+			flattenValue(flat, key+"."+fk, fv)
+		}
+	case *structpb.Value_ListValue:
+		if len(k.ListValue.GetValues()) == 0 {
+			flat[key] = []any{}
+			return
+		}
+
+		for i, lv := range k.ListValue.GetValues() {
+			flattenValue(flat, key+"."+strconv.Itoa(i), lv)
+		}
+	default:
+		flat[key] = v.AsInterface()
+	}
+}
+
+// protoFieldValue returns the value of the given field of the message as a Go value that can be converted to structpb.
+func protoFieldValue(m protoreflect.Message, fd protoreflect.FieldDescriptor) (any, error) {
+	v := m.Get(fd)
+	switch {
+	case fd.IsList():
+		l := v.List()
+		out := make([]any, l.Len())
+		for i := 0; i < l.Len(); i++ {
+			item, err := protoScalarValue(fd, l.Get(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = item
+		}
+		return out, nil
+	case fd.IsMap():
+		out := make(map[string]any, v.Map().Len())
+		var err error
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			var item any
+			if item, err = protoScalarValue(fd.MapValue(), mv); err != nil {
+				return false
+			}
+			out[k.String()] = item
+			return true
+		})
+		return out, err
+	case fd.Message() != nil && !m.Has(fd):
+		return nil, nil
+	default:
+		return protoScalarValue(fd, v)
+	}
+}
+
+func protoScalarValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (any, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool(), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int(), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint(), nil
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float(), nil
+	case protoreflect.StringKind:
+		return v.String(), nil
+	case protoreflect.BytesKind:
+		return v.Bytes(), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name()), nil
+		}
+		return int64(v.Enum()), nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		j, err := protojson.Marshal(v.Message().Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		var out any
+		if err := json.Unmarshal(j, &out); err != nil {
+			return nil, err
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported field kind %s", fd.Kind())
+	}
+}
+
+// AttrTypeRecorder remembers the type of each attribute it is shown and flags attributes whose type changes.
+// It is intended as a debugging aid for catching changes to the shape of the data sent in requests.
+// A recorder can be shared between principals and resources and is safe for concurrent use.
+type AttrTypeRecorder struct {
+	types map[string]string
+	mu    sync.Mutex
+}
+
+// NewAttrTypeRecorder creates a new attribute type recorder.
+func NewAttrTypeRecorder() *AttrTypeRecorder {
+	return &AttrTypeRecorder{types: make(map[string]string)}
+}
+
+// Check records the type of the given attribute value and returns an error if a value of a different type was
+// previously seen for the same key. Null values are ignored. A nil recorder doesn't check anything.
+func (r *AttrTypeRecorder) Check(key string, v *structpb.Value) error {
+	if r == nil {
+		return nil
+	}
+
+	typ := attrTypeName(v)
+	if typ == "" {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prev, ok := r.types[key]; ok && prev != typ {
+		return fmt.Errorf("type of attribute '%s' changed from %s to %s", key, prev, typ)
+	}
+
+	r.types[key] = typ
+	return nil
+}
+
+func attrTypeName(v *structpb.Value) string {
+	switch v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return "bool"
+	case *structpb.Value_NumberValue:
+		return "number"
+	case *structpb.Value_StringValue:
+		return "string"
+	case *structpb.Value_ListValue:
+		return "list"
+	case *structpb.Value_StructValue:
+		return "map"
+	default:
+		return ""
+	}
+}
+
+// jsonToAttrPB decodes a JSON object into attribute values. Integers that can't be represented exactly by a float64
+// are encoded as decimal strings, in the same way as WithInt64Attr.
+func jsonToAttrPB(data []byte) (map[string]*structpb.Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON object: %w", err)
+	}
+
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON object")
+	}
+
+	attr := make(map[string]*structpb.Value, len(obj))
+	for k, v := range obj {
+		attr[k] = jsonValueToStructPB(v)
+	}
+
+	return attr, nil
+}
+
+func jsonValueToStructPB(v any) *structpb.Value {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return int64ToStructPB(n)
+		}
+
+		if n, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return uint64ToStructPB(n)
+		}
+
+		f, err := t.Float64()
+		if err != nil {
+			return structpb.NewStringValue(t.String())
+		}
+		return structpb.NewNumberValue(f)
+	case map[string]any:
+		fields := make(map[string]*structpb.Value, len(t))
+		for k, fv := range t {
+			fields[k] = jsonValueToStructPB(fv)
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields})
+	case []any:
+		values := make([]*structpb.Value, len(t))
+		for i, lv := range t {
+			values[i] = jsonValueToStructPB(lv)
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values})
+	case string:
+		return structpb.NewStringValue(t)
+	case bool:
+		return structpb.NewBoolValue(t)
+	default:
+		return structpb.NewNullValue()
+	}
+}
+
+// structToAttrs converts the exported fields of a struct to attribute values, honouring `json` field tags.
+// Fields of embedded structs without a tag name are promoted to the top level, as encoding/json does.
+func structToAttrs(v any) (map[string]any, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, errors.New("value is a nil pointer")
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct, got %s", rv.Type())
+	}
+
+	attr := make(map[string]any)
+	if err := collectStructFields(attr, rv); err != nil {
+		return nil, err
+	}
+
+	return attr, nil
+}
+
+func collectStructFields(attr map[string]any, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := rv.Field(i)
+
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				if fv.Kind() == reflect.Pointer {
+					if fv.IsNil() {
+						continue
+					}
+					fv = fv.Elem()
+				}
+
+				if err := collectStructFields(attr, fv); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+
+		if strings.Contains(opts, "omitempty") && fv.IsZero() {
+			continue
+		}
+
+		val, err := reflectAttrValue(fv)
+		if err != nil {
+			return fmt.Errorf("field '%s': %w", sf.Name, err)
+		}
+		attr[name] = val
+	}
+
+	return nil
+}
+
+// leafAttrValue converts values that have their own representation instead of being decomposed into their fields:
+// values handled by a registered AttrConverter, time.Time and implementations of json.Marshaler.
+// It returns false if the value is not one of those.
+func leafAttrValue(rv reflect.Value) (any, bool, error) {
+	if !rv.IsValid() || !rv.CanInterface() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return nil, false, nil
+	}
+
+	v := rv.Interface()
+	if pbVal, ok, err := customStructPB(v); err != nil {
+		return nil, false, err
+	} else if ok {
+		return pbVal.AsInterface(), true, nil
+	}
+
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(time.RFC3339), true, nil
+	case json.Marshaler:
+		j, err := t.MarshalJSON()
+		if err != nil {
+			return nil, false, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(j))
+		dec.UseNumber()
+
+		var out any
+		if err := dec.Decode(&out); err != nil {
+			return nil, false, err
+		}
+		return jsonValueToStructPB(out).AsInterface(), true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+func reflectAttrValue(rv reflect.Value) (any, error) {
+	if v, ok, err := leafAttrValue(rv); ok || err != nil {
+		return v, err
+	}
+
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return reflectAttrValue(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// Arrays in structs passed by value are not addressable, so their bytes must be copied.
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return b, nil
+		}
+
+		out := make([]any, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item, err := reflectAttrValue(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = item
+		}
+		return out, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", rv.Type().Key())
+		}
+
+		if rv.IsNil() {
+			return nil, nil
+		}
+
+		out := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			item, err := reflectAttrValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			out[iter.Key().String()] = item
+		}
+		return out, nil
+	case reflect.Struct:
+		out := make(map[string]any)
+		if err := collectStructFields(out, rv); err != nil {
+			return nil, err
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", rv.Type())
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.uber.org/multierr"
+
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	"github.com/cerbos/cerbos/internal/conditions"
+	"github.com/cerbos/cerbos/internal/policy"
+)
+
+// SeverityError is the severity of diagnostics that make a policy invalid.
+const SeverityError = "error"
+
+// ValidationProfile determines which checks are applied when validating a policy.
+type ValidationProfile int
+
+const (
+	// ServerCompatible only enforces the checks that the Cerbos server enforces when loading policies.
+	// It is intended for machine-generated policies.
+	ServerCompatible ValidationProfile = iota
+	// Strict enforces the ServerCompatible checks as well as the registered lint rules, which are intended for
+	// hand-written policies. See Lint.
+	Strict
+)
+
+// Diagnostic describes a single problem found while validating a policy.
+type Diagnostic struct {
+	// Field is the path to the offending field, if known.
+	Field string `json:"field"`
+	// Message is a human-readable description of the problem.
+	Message string `json:"message"`
+	// Severity is the severity of the problem.
+	Severity string `json:"severity"`
+}
+
+// ValidatePolicyJSON validates the policy using the given profile, like ValidatePolicy, and returns the problems found
+// as a JSON array of diagnostics. An empty array is returned if the policy is valid.
+func ValidatePolicyJSON(p *policyv1.Policy, profile ValidationProfile) ([]byte, error) {
+	diags := []Diagnostic{}
+	_ = validatePolicy(p, profile, func(d Diagnostic) {
+		diags = append(diags, d)
+	})
+
+	out, err := json.Marshal(diags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal diagnostics: %w", err)
+	}
+
+	return out, nil
+}
+
+func policyDiagnostics(p *policyv1.Policy) []Diagnostic {
+	if err := p.ValidateAll(); err != nil {
+		return protoDiagnostics("", err, nil)
+	}
+
+	var diags []Diagnostic
+	for _, err := range multierr.Errors(policy.Validate(p)) {
+		diags = append(diags, Diagnostic{Message: err.Error(), Severity: SeverityError})
+	}
+
+	return diags
+}
+
+// protoDiagnostics flattens the nested errors produced by the generated protobuf validators into diagnostics.
+func protoDiagnostics(prefix string, err error, diags []Diagnostic) []Diagnostic {
+	switch e := err.(type) {
+	case interface{ AllErrors() []error }:
+		for _, ee := range e.AllErrors() {
+			diags = protoDiagnostics(prefix, ee, diags)
+		}
+		return diags
+	case interface {
+		Field() string
+		Reason() string
+		Cause() error
+	}:
+		field := e.Field()
+		if prefix != "" {
+			field = prefix + "." + field
+		}
+
+		if cause := e.Cause(); cause != nil {
+			return protoDiagnostics(field, cause, diags)
+		}
+
+		return append(diags, Diagnostic{Field: field, Message: e.Reason(), Severity: SeverityError})
+	default:
+		return append(diags, Diagnostic{Field: prefix, Message: err.Error(), Severity: SeverityError})
+	}
+}
+
+// ValidatePolicyStreaming validates the policy and calls report for each problem as it is found.
+// Structural problems are reported first, followed by the CEL compilation errors of each rule and variable definition.
+// Validation stops as soon as report returns false. The returned error combines all the problems that were reported.
+func ValidatePolicyStreaming(p *policyv1.Policy, report func(Diagnostic) bool) error {
+	var err error
+	emit := func(d Diagnostic) bool {
+		if d.Field == "" {
+			err = multierr.Append(err, errors.New(d.Message))
+		} else {
+			err = multierr.Append(err, fmt.Errorf("%s: %s", d.Field, d.Message))
+		}
+
+		return report(d)
+	}
+
+	for _, d := range policyDiagnostics(p) {
+		if !emit(d) {
+			return err
+		}
+	}
+
+	for _, re := range append(ruleExprs(p), variableExprs(p)...) {
+		if _, iss := conditions.StdEnv.Compile(re.expr); iss.Err() != nil {
+			if !emit(Diagnostic{Field: re.field, Message: iss.Err().Error(), Severity: SeverityError}) {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+type ruleExpr struct {
+	field string
+	rule  string
+	expr  string
+}
+
+// ruleExprs returns the condition and output expressions from the rules of the policy.
+func ruleExprs(p *policyv1.Policy) []ruleExpr {
+	var exprs []ruleExpr
+	switch pt := p.PolicyType.(type) {
+	case *policyv1.Policy_ResourcePolicy:
+		for i, rule := range pt.ResourcePolicy.GetRules() {
+			field := fmt.Sprintf("ResourcePolicy.Rules[%d]", i)
+			exprs = appendMatchExprs(exprs, field+".Condition.Match", rule.GetName(), rule.GetCondition().GetMatch())
+			if out := rule.GetOutput().GetExpr(); out != "" {
+				exprs = append(exprs, ruleExpr{field: field + ".Output.Expr", rule: rule.GetName(), expr: out})
+			}
+		}
+	case *policyv1.Policy_PrincipalPolicy:
+		for i, rule := range pt.PrincipalPolicy.GetRules() {
+			for j, action := range rule.GetActions() {
+				field := fmt.Sprintf("PrincipalPolicy.Rules[%d].Actions[%d]", i, j)
+				exprs = appendMatchExprs(exprs, field+".Condition.Match", action.GetName(), action.GetCondition().GetMatch())
+				if out := action.GetOutput().GetExpr(); out != "" {
+					exprs = append(exprs, ruleExpr{field: field + ".Output.Expr", rule: action.GetName(), expr: out})
+				}
+			}
+		}
+	case *policyv1.Policy_DerivedRoles:
+		for i, def := range pt.DerivedRoles.GetDefinitions() {
+			exprs = appendMatchExprs(exprs, fmt.Sprintf("DerivedRoles.Definitions[%d].Condition.Match", i), def.GetName(), def.GetCondition().GetMatch())
+		}
+	}
+
+	return exprs
+}
+
+func appendMatchExprs(exprs []ruleExpr, field, rule string, m *policyv1.Match) []ruleExpr {
+	appendList := func(name string, of []*policyv1.Match) []ruleExpr {
+		for i, mm := range of {
+			exprs = appendMatchExprs(exprs, fmt.Sprintf("%s.%s.Of[%d]", field, name, i), rule, mm)
+		}
+		return exprs
+	}
+
+	switch t := m.GetOp().(type) {
+	case *policyv1.Match_Expr:
+		return append(exprs, ruleExpr{field: field + ".Expr", rule: rule, expr: t.Expr})
+	case *policyv1.Match_All:
+		return appendList("All", t.All.GetOf())
+	case *policyv1.Match_Any:
+		return appendList("Any", t.Any.GetOf())
+	case *policyv1.Match_None:
+		return appendList("None", t.None.GetOf())
+	default:
+		return exprs
+	}
+}
+
+// variableExprs returns the variable definitions of the policy, sorted by variable name.
+func variableExprs(p *policyv1.Policy) []ruleExpr {
+	var prefix string
+	var defs map[string]string
+	switch pt := p.PolicyType.(type) {
+	case *policyv1.Policy_ResourcePolicy:
+		prefix, defs = "ResourcePolicy.Variables.Local", pt.ResourcePolicy.GetVariables().GetLocal()
+	case *policyv1.Policy_PrincipalPolicy:
+		prefix, defs = "PrincipalPolicy.Variables.Local", pt.PrincipalPolicy.GetVariables().GetLocal()
+	case *policyv1.Policy_DerivedRoles:
+		prefix, defs = "DerivedRoles.Variables.Local", pt.DerivedRoles.GetVariables().GetLocal()
+	case *policyv1.Policy_ExportVariables:
+		prefix, defs = "ExportVariables.Definitions", pt.ExportVariables.GetDefinitions()
+	}
+
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exprs := make([]ruleExpr, 0, len(names)+len(p.GetVariables()))
+	for _, name := range names {
+		exprs = append(exprs, ruleExpr{field: fmt.Sprintf("%s[%s]", prefix, name), rule: name, expr: defs[name]})
+	}
+
+	// Top-level variables are deprecated but still evaluated by the engine.
+	names = names[:0]
+	for name := range p.GetVariables() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		exprs = append(exprs, ruleExpr{field: fmt.Sprintf("Variables[%s]", name), rule: name, expr: p.GetVariables()[name]})
+	}
+
+	return exprs
+}
+
+// ValidatePolicy validates the policy, including compiling its condition and output expressions, using the given profile.
+func ValidatePolicy(p *policyv1.Policy, profile ValidationProfile) error {
+	return validatePolicy(p, profile, func(Diagnostic) {})
+}
+
+func validatePolicy(p *policyv1.Policy, profile ValidationProfile, report func(Diagnostic)) error {
+	err := ValidatePolicyStreaming(p, func(d Diagnostic) bool {
+		report(d)
+		return true
+	})
+
+	if profile == Strict {
+		lintErr := strictLints(p)
+		for _, le := range multierr.Errors(lintErr) {
+			report(Diagnostic{Message: le.Error(), Severity: SeverityError})
+		}
+		err = multierr.Append(err, lintErr)
+	}
+
+	return err
+}
+
+func strictLints(p *policyv1.Policy) error {
+	var err error
+	for _, issue := range Lint(p) {
+		err = multierr.Append(err, errors.New(issue.Message))
+	}
+
+	return err
+}
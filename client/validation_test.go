@@ -0,0 +1,224 @@
+// Copyright 2021-2023 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tests
+// +build tests
+
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+)
+
+func TestValidatePolicyJSON(t *testing.T) {
+	resourcePolicy := func(resource string, rules ...*policyv1.ResourceRule) *policyv1.Policy {
+		return &policyv1.Policy{
+			ApiVersion: apiVersion,
+			PolicyType: &policyv1.Policy_ResourcePolicy{
+				ResourcePolicy: &policyv1.ResourcePolicy{Resource: resource, Version: "default", Rules: rules},
+			},
+		}
+	}
+
+	testCases := []struct {
+		policy  *policyv1.Policy
+		name    string
+		want    []Diagnostic
+		profile ValidationProfile
+	}{
+		{
+			name: "valid",
+			policy: resourcePolicy("leave_request", &policyv1.ResourceRule{
+				Actions: []string{"view"},
+				Roles:   []string{"user"},
+				Effect:  effectv1.Effect_EFFECT_ALLOW,
+			}),
+			want: []Diagnostic{},
+		},
+		{
+			name: "structural errors",
+			policy: resourcePolicy("", &policyv1.ResourceRule{
+				Roles:  []string{"user"},
+				Effect: effectv1.Effect_EFFECT_ALLOW,
+			}),
+			want: []Diagnostic{
+				{Field: "ResourcePolicy.Resource", Message: "value length must be at least 1 runes", Severity: SeverityError},
+				{Field: "ResourcePolicy.Rules[0].Actions", Message: "value must contain at least 1 item(s)", Severity: SeverityError},
+			},
+		},
+		{
+			name: "semantic errors",
+			policy: resourcePolicy("leave_request", &policyv1.ResourceRule{
+				Actions: []string{"view"},
+				Effect:  effectv1.Effect_EFFECT_ALLOW,
+			}),
+			want: []Diagnostic{
+				{Message: "rule #1 does not specify any roles or derived roles to match", Severity: SeverityError},
+			},
+		},
+		{
+			name: "expression errors",
+			policy: resourcePolicy("leave_request", &policyv1.ResourceRule{
+				Actions: []string{"view"},
+				Roles:   []string{"user"},
+				Effect:  effectv1.Effect_EFFECT_ALLOW,
+				Output:  &policyv1.Output{Expr: "P.id +"},
+			}),
+			want: []Diagnostic{
+				{Field: "ResourcePolicy.Rules[0].Output.Expr", Severity: SeverityError},
+			},
+		},
+		{
+			name:    "strict lints",
+			profile: Strict,
+			policy: resourcePolicy("leave_request", &policyv1.ResourceRule{
+				Actions: []string{"view"},
+				Roles:   []string{"user"},
+				Effect:  effectv1.Effect_EFFECT_ALLOW,
+			}),
+			want: []Diagnostic{
+				{Message: "rule #1 does not have a name", Severity: SeverityError},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := ValidatePolicyJSON(tc.policy, tc.profile)
+			require.NoError(t, err)
+
+			var have []Diagnostic
+			require.NoError(t, json.Unmarshal(out, &have))
+			require.Len(t, have, len(tc.want))
+			for i, want := range tc.want {
+				if want.Message == "" {
+					want.Message = have[i].Message
+				}
+				require.Equal(t, want, have[i])
+			}
+		})
+	}
+}
+
+func TestValidatePolicyStreaming(t *testing.T) {
+	p := &policyv1.Policy{
+		ApiVersion: apiVersion,
+		PolicyType: &policyv1.Policy_ResourcePolicy{
+			ResourcePolicy: &policyv1.ResourcePolicy{
+				Resource: "leave_request",
+				Version:  "default",
+				Rules: []*policyv1.ResourceRule{
+					{
+						Actions: []string{"view"},
+						Effect:  effectv1.Effect_EFFECT_ALLOW,
+						Condition: &policyv1.Condition{Condition: &policyv1.Condition_Match{Match: &policyv1.Match{
+							Op: &policyv1.Match_All{All: &policyv1.Match_ExprList{Of: []*policyv1.Match{
+								{Op: &policyv1.Match_Expr{Expr: "R.attr.public == true"}},
+								{Op: &policyv1.Match_Expr{Expr: "R.attr.owner =="}},
+							}}},
+						}}},
+						Output: &policyv1.Output{Expr: "R.id"},
+					},
+					{
+						Actions: []string{"edit"},
+						Roles:   []string{"user"},
+						Effect:  effectv1.Effect_EFFECT_ALLOW,
+						Output:  &policyv1.Output{Expr: "P.id +"},
+					},
+				},
+			},
+		},
+	}
+
+	var fields []string
+	err := ValidatePolicyStreaming(p, func(d Diagnostic) bool {
+		require.Equal(t, SeverityError, d.Severity)
+		fields = append(fields, d.Field)
+		return true
+	})
+	require.Error(t, err)
+	require.Len(t, multierr.Errors(err), 3)
+	require.Equal(t, []string{
+		"",
+		"ResourcePolicy.Rules[0].Condition.Match.All.Of[1].Expr",
+		"ResourcePolicy.Rules[1].Output.Expr",
+	}, fields)
+
+	var calls int
+	err = ValidatePolicyStreaming(p, func(d Diagnostic) bool {
+		calls++
+		return calls < 2
+	})
+	require.Equal(t, 2, calls)
+	require.Len(t, multierr.Errors(err), 2)
+
+	p.GetResourcePolicy().Rules = p.GetResourcePolicy().Rules[:1]
+	p.GetResourcePolicy().Rules[0] = &policyv1.ResourceRule{Actions: []string{"view"}, Roles: []string{"user"}, Effect: effectv1.Effect_EFFECT_ALLOW}
+	require.NoError(t, ValidatePolicyStreaming(p, func(d Diagnostic) bool {
+		t.Errorf("unexpected diagnostic: %v", d)
+		return true
+	}))
+}
+
+func TestValidatePolicyVariables(t *testing.T) {
+	p := &policyv1.Policy{
+		ApiVersion: apiVersion,
+		PolicyType: &policyv1.Policy_ResourcePolicy{
+			ResourcePolicy: &policyv1.ResourcePolicy{
+				Resource: "leave_request",
+				Version:  "default",
+				Variables: &policyv1.Variables{Local: map[string]string{
+					"is_owner": "R.attr.owner == P.id",
+					"broken":   "R.attr.owner ==",
+				}},
+				Rules: []*policyv1.ResourceRule{
+					{Name: "view", Actions: []string{"view"}, Roles: []string{"user"}, Effect: effectv1.Effect_EFFECT_ALLOW},
+				},
+			},
+		},
+	}
+
+	var fields []string
+	err := ValidatePolicyStreaming(p, func(d Diagnostic) bool {
+		fields = append(fields, d.Field)
+		return true
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{"ResourcePolicy.Variables.Local[broken]"}, fields)
+	require.Error(t, ValidatePolicy(p, ServerCompatible))
+
+	delete(p.GetResourcePolicy().Variables.Local, "broken")
+	require.NoError(t, ValidatePolicy(p, ServerCompatible))
+}
+
+func TestValidationProfile(t *testing.T) {
+	p := &policyv1.Policy{
+		ApiVersion: apiVersion,
+		PolicyType: &policyv1.Policy_ResourcePolicy{
+			ResourcePolicy: &policyv1.ResourcePolicy{
+				Resource: "leave_request",
+				Version:  "default",
+				Rules: []*policyv1.ResourceRule{
+					{Name: "view", Actions: []string{"view"}, Roles: []string{"user"}, Effect: effectv1.Effect_EFFECT_ALLOW},
+					{Actions: []string{"edit"}, Roles: []string{"user"}, Effect: effectv1.Effect_EFFECT_ALLOW},
+				},
+			},
+		},
+	}
+
+	require.NoError(t, ValidatePolicy(p, ServerCompatible))
+	require.EqualError(t, ValidatePolicy(p, Strict), "rule #2 does not have a name")
+
+	ps := NewPolicySet().AddPolicies(p)
+	require.NoError(t, ps.ValidateAll(ServerCompatible))
+	require.ErrorContains(t, ps.ValidateAll(Strict), "rule #2 does not have a name")
+	require.NoError(t, ps.ValidateAllParallel(2))
+}
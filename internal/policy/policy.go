@@ -5,8 +5,11 @@ package policy
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
@@ -181,6 +184,52 @@ func SchemaReferences(p *policyv1.Policy) []string {
 	}
 }
 
+// DeprecatedFields returns the paths of the fields set in the policy that are marked as deprecated in the proto definition.
+func DeprecatedFields(p *policyv1.Policy) []string {
+	var fields []string
+	collectDeprecatedFields(p.ProtoReflect(), "", &fields)
+	sort.Strings(fields)
+	return fields
+}
+
+func collectDeprecatedFields(m protoreflect.Message, prefix string, fields *[]string) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		path := fd.JSONName()
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && opts.GetDeprecated() {
+			*fields = append(*fields, path)
+		}
+
+		if fd.Message() == nil {
+			return true
+		}
+
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				collectDeprecatedFields(list.Get(i).Message(), fmt.Sprintf("%s[%d]", path, i), fields)
+			}
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				collectDeprecatedFields(mv.Message(), fmt.Sprintf("%s[%s]", path, k.String()), fields)
+				return true
+			})
+		default:
+			collectDeprecatedFields(v.Message(), path, fields)
+		}
+
+		return true
+	})
+}
+
 func GetScope(p *policyv1.Policy) string {
 	switch pt := p.PolicyType.(type) {
 	case *policyv1.Policy_ResourcePolicy: